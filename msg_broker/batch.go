@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type PublishResult struct {
+	Message Message
+	// Receivers is the number of subscribers PUBLISH reached; it is always
+	// zero for the streams transport.
+	Receivers int64
+	Err       error
+}
+
+// PublishBatch sends all messages in a single pipeline round-trip and
+// reports the outcome of each one in the order given. Brokers other than
+// Redis, and publishers with middleware, publish the messages one by one
+// so that every message passes through PublishMessages.
+func (p *MessagePublisher) PublishBatch(ctx context.Context, messages []Message) []PublishResult {
+	results := make([]PublishResult, len(messages))
+	redisClient, ok := p.broker.(Redis)
+	if !ok || len(p.middleware) > 0 {
+		for i, message := range messages {
+			results[i].Message = message
+			results[i].Receivers, results[i].Err = p.PublishMessages(ctx, message)
+		}
+		return results
+	}
+
+	defer func() {
+		for _, result := range results {
+			p.metrics.observePublish(result.Message.Channel, result.Err)
+		}
+	}()
+
+	cmds := make([]redis.Cmder, len(messages))
+	payloads := make([][]byte, len(messages))
+
+	pipe := redisClient.RedisClient.Pipeline()
+	queued := 0
+	for i, message := range messages {
+		results[i].Message = message
+
+		serializedMessage, err := p.serialize(injectTraceContext(ctx, message))
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		payloads[i] = serializedMessage
+		if p.transport == TransportStreams {
+			cmds[i] = pipe.XAdd(ctx, p.streamArgs(message.Channel, serializedMessage))
+		} else {
+			cmds[i] = redisClient.publish(ctx, pipe, message.Channel, serializedMessage)
+		}
+		queued++
+	}
+	if queued == 0 {
+		return results
+	}
+	if err := ctx.Err(); err != nil {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = err
+			}
+		}
+		return results
+	}
+
+	// Exec only returns the first failure; each command carries its own.
+	pipe.Exec(ctx)
+	unreceived := make([]int, 0)
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		results[i].Err = cmd.Err()
+		if publish, ok := cmd.(*redis.IntCmd); ok && publish.Err() == nil {
+			results[i].Receivers = publish.Val()
+			if results[i].Receivers == 0 {
+				unreceived = append(unreceived, i)
+			}
+		}
+	}
+	p.applyBatchDeliveryPolicy(ctx, redisClient, results, payloads, unreceived)
+	return results
+}
+
+func (p *MessagePublisher) applyBatchDeliveryPolicy(ctx context.Context, redisClient Redis, results []PublishResult, payloads [][]byte, unreceived []int) {
+	if len(unreceived) == 0 {
+		return
+	}
+
+	switch p.policy {
+	case DeliverRequireSubscribers:
+		for _, i := range unreceived {
+			results[i].Err = ErrNoSubscribers
+		}
+	case DeliverFallbackToList:
+		pipe := redisClient.RedisClient.Pipeline()
+		cmds := make([]*redis.IntCmd, len(unreceived))
+		for j, i := range unreceived {
+			cmds[j] = pipe.RPush(ctx, fallbackKey(results[i].Message.Channel), payloads[i])
+		}
+		pipe.Exec(ctx)
+		for j, i := range unreceived {
+			results[i].Err = cmds[j].Err()
+		}
+	}
+}
+
+type BatchOptions struct {
+	MaxBatchSize  int
+	FlushInterval time.Duration
+}
+
+// BatchPublisher buffers messages and publishes them with PublishBatch once
+// MaxBatchSize messages are queued or FlushInterval has passed, whichever
+// comes first. Results are handed to the callback given at construction.
+type BatchPublisher struct {
+	publisher *MessagePublisher
+	options   BatchOptions
+	onResults func([]PublishResult)
+	mu        sync.Mutex
+	pending   []Message
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func NewBatchPublisher(publisher *MessagePublisher, options BatchOptions, onResults func([]PublishResult)) *BatchPublisher {
+	b := &BatchPublisher{
+		publisher: publisher,
+		options:   options,
+		onResults: onResults,
+		pending:   make([]Message, 0, options.MaxBatchSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go b.flushLoop()
+	return b
+}
+
+func (b *BatchPublisher) Add(ctx context.Context, message Message) {
+	b.mu.Lock()
+	b.pending = append(b.pending, message)
+	full := b.options.MaxBatchSize > 0 && len(b.pending) >= b.options.MaxBatchSize
+	b.mu.Unlock()
+
+	if full {
+		b.Flush(ctx)
+	}
+}
+
+func (b *BatchPublisher) Flush(ctx context.Context) {
+	b.mu.Lock()
+	messages := b.pending
+	b.pending = make([]Message, 0, b.options.MaxBatchSize)
+	b.mu.Unlock()
+
+	if len(messages) == 0 {
+		return
+	}
+	results := b.publisher.PublishBatch(ctx, messages)
+	if b.onResults != nil {
+		b.onResults(results)
+	}
+}
+
+// Close stops the flush timer and publishes whatever is still buffered.
+func (b *BatchPublisher) Close(ctx context.Context) {
+	close(b.stop)
+	<-b.done
+	b.Flush(ctx)
+}
+
+func (b *BatchPublisher) flushLoop() {
+	defer close(b.done)
+	if b.options.FlushInterval <= 0 {
+		<-b.stop
+		return
+	}
+
+	ticker := time.NewTicker(b.options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.Flush(context.Background())
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSubscriptionClosed = errors.New("subscription closed")
+	ErrBrokerClosed       = errors.New("broker closed")
+	ErrListEmpty          = errors.New("list is empty")
+	ErrListsUnsupported   = errors.New("broker does not support lists")
+	ErrKeysUnsupported    = errors.New("broker does not support keys")
+)
+
+// Broker is the transport MessagePublisher and MessageConsumer run on.
+// Redis is the production implementation; MemoryBroker keeps everything
+// in-process for tests.
+type Broker interface {
+	Publish(ctx context.Context, channel string, payload []byte) (int64, error)
+	// Subscribe and PSubscribe return once the subscription is active, so
+	// messages published afterwards are guaranteed to be received.
+	Subscribe(ctx context.Context, channels ...string) (Subscription, error)
+	PSubscribe(ctx context.Context, patterns ...string) (Subscription, error)
+	Close() error
+}
+
+// ListBroker is implemented by brokers that can also store messages in
+// lists, which delivery fallbacks and dead-letter queues rely on.
+type ListBroker interface {
+	Push(ctx context.Context, key string, payload []byte) error
+	// Pop removes the oldest entry, returning ErrListEmpty if there is none.
+	Pop(ctx context.Context, key string) ([]byte, error)
+	Range(ctx context.Context, key string, start, stop int64) ([][]byte, error)
+	Len(ctx context.Context, key string) (int64, error)
+}
+
+// KeyBroker is implemented by brokers that can store expiring keys, which
+// message deduplication relies on.
+type KeyBroker interface {
+	// SetNX sets key unless it already exists, reporting whether it did.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Get returns nil for a missing key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type BrokerMessage struct {
+	Channel string
+	// Pattern is the pattern that matched, for pattern subscriptions.
+	Pattern string
+	Payload []byte
+}
+
+// Subscription is a single connection multiplexing any number of channel
+// and pattern subscriptions, which can be changed while it is receiving.
+type Subscription interface {
+	// Receive blocks until a message arrives or the subscription fails.
+	// pingInterval bounds how long a silent connection is trusted before
+	// the broker checks that it is still alive.
+	Receive(pingInterval time.Duration) (BrokerMessage, error)
+	Subscribe(ctx context.Context, channels ...string) error
+	Unsubscribe(ctx context.Context, channels ...string) error
+	PSubscribe(ctx context.Context, patterns ...string) error
+	PUnsubscribe(ctx context.Context, patterns ...string) error
+	Close() error
+}
+
+func listBroker(broker Broker) (ListBroker, error) {
+	lists, ok := broker.(ListBroker)
+	if !ok {
+		return nil, ErrListsUnsupported
+	}
+	return lists, nil
+}
+
+func keyBroker(broker Broker) (KeyBroker, error) {
+	keys, ok := broker.(KeyBroker)
+	if !ok {
+		return nil, ErrKeysUnsupported
+	}
+	return keys, nil
+}
+
+// globMatch implements Redis glob-style matching as used by PSUBSCRIBE:
+// '*', '?', '[...]' (with '^' negation and ranges) and '\' escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := 1
+			negate := end < len(pattern) && pattern[end] == '^'
+			if negate {
+				end++
+			}
+			matched := false
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' && end+1 < len(pattern) {
+					end++
+				}
+				if end+2 < len(pattern) && pattern[end+1] == '-' && pattern[end+2] != ']' {
+					low, high := pattern[end], pattern[end+2]
+					if low > high {
+						low, high = high, low
+					}
+					if s[0] >= low && s[0] <= high {
+						matched = true
+					}
+					end += 3
+					continue
+				}
+				if pattern[end] == s[0] {
+					matched = true
+				}
+				end++
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end:]
+			if len(pattern) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
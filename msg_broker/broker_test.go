@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "orders", true},
+		{"orders", "orders", true},
+		{"orders", "order", false},
+		{"ord*", "orders", true},
+		{"ord.*", "orders", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders", false},
+		{"*.created", "orders.created", true},
+		{"a**b", "axxb", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{"[abc", "a", false},
+	}
+	for _, test := range tests {
+		if got := globMatch(test.pattern, test.s); got != test.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
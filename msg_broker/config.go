@@ -1,25 +1,464 @@
 package main
 
-import "os"
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
-	RedisHost     string
-	RedisPort     string
-	RedisPassword string
+	RedisMode        RedisMode
+	RedisURL         string
+	RedisAddrs       []string
+	SentinelMaster   string
+	SentinelPassword string
+	ShardedPubSub    bool
+	RedisHost        string
+	RedisPort        string
+	RedisUsername    string
+	RedisPassword    string
+	RedisDB          int
+	TLS              TLSOptions
+	Pool             PoolOptions
+	Producer         string
+	Codec            string
+	DeliveryPolicy   string
+	ShutdownTimeout  time.Duration
+	Transport        Transport
+	Streams          StreamOptions
+	Reconnect        ReconnectOptions
+	DeadLetterKey    string
+	DeadLetterTarget DeadLetterTarget
+	MetricsAddr      string
+	Workers          int
+	BufferSize       int
+	OverflowPolicy   string
+	SpillScope       string
+	Deduplication    DeduplicationOptions
+	Schedule         ScheduleOptions
+	RunScheduler     bool
+	// Schemas maps channels to JSON Schema files.
+	Schemas map[string]string
+	// Signing and Encryption hold base64 encoded keys by ID; messages on
+	// EncryptedChannels are encrypted.
+	Signing           KeyringOptions
+	Encryption        KeyringOptions
+	EncryptedChannels []string
 }
 
-func LoadConfig() Config {
-	return Config{
-		RedisHost:     getEnv("REDIS_HOST", "localhost"),
-		RedisPort:     getEnv("REDIS_PORT", "6379"),
-		RedisPassword: getEnv("REDIS_PASSWORD", ""),
+type TLSOptions struct {
+	Enabled            bool
+	CAFile             string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+type PoolOptions struct {
+	// Size is the maximum number of connections; 0 keeps the go-redis
+	// default of 10 per CPU.
+	Size         int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// LoadConfig reads the configuration from environment variables and, if
+// MSG_BROKER_CONFIG names one, a KEY=VALUE file using the same keys.
+// Environment variables take precedence over the file, and REDIS_HOST,
+// REDIS_PORT etc. take precedence over the parts of REDIS_URL. All invalid
+// values are reported together.
+func LoadConfig() (Config, error) {
+	source := &configSource{}
+	if path, ok := os.LookupEnv("MSG_BROKER_CONFIG"); ok && path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		source.file = file
+	}
+
+	redisURL := source.getEnv("REDIS_URL", "")
+	defaults := Config{RedisHost: "localhost", RedisPort: "6379"}
+	if redisURL != "" {
+		if err := parseRedisURL(redisURL, &defaults); err != nil {
+			source.errs = append(source.errs, fmt.Errorf("REDIS_URL: %w", err))
+		}
+	}
+
+	config := Config{
+		RedisMode:        RedisMode(source.getEnv("REDIS_MODE", string(RedisStandalone))),
+		RedisURL:         redisURL,
+		RedisHost:        source.getEnv("REDIS_HOST", defaults.RedisHost),
+		RedisPort:        source.getEnv("REDIS_PORT", defaults.RedisPort),
+		RedisUsername:    source.getEnv("REDIS_USERNAME", defaults.RedisUsername),
+		RedisPassword:    source.getEnv("REDIS_PASSWORD", defaults.RedisPassword),
+		RedisDB:          int(source.getEnvInt("REDIS_DB", int64(defaults.RedisDB))),
+		SentinelMaster:   source.getEnv("REDIS_SENTINEL_MASTER", ""),
+		SentinelPassword: source.getEnv("REDIS_SENTINEL_PASSWORD", ""),
+		ShardedPubSub:    source.getEnvBool("REDIS_SHARDED_PUBSUB", false),
+		TLS: TLSOptions{
+			Enabled:            source.getEnvBool("REDIS_TLS", defaults.TLS.Enabled),
+			CAFile:             source.getEnv("REDIS_TLS_CA_FILE", ""),
+			ServerName:         source.getEnv("REDIS_TLS_SERVER_NAME", ""),
+			InsecureSkipVerify: source.getEnvBool("REDIS_TLS_INSECURE_SKIP_VERIFY", false),
+		},
+		Pool: PoolOptions{
+			Size:         int(source.getEnvInt("REDIS_POOL_SIZE", 0)),
+			DialTimeout:  source.getEnvDuration("REDIS_DIAL_TIMEOUT", 5*time.Second),
+			ReadTimeout:  source.getEnvDuration("REDIS_READ_TIMEOUT", 3*time.Second),
+			WriteTimeout: source.getEnvDuration("REDIS_WRITE_TIMEOUT", 3*time.Second),
+		},
+		Producer:        source.getEnv("MSG_BROKER_PRODUCER", "msg_broker"),
+		Codec:           source.getEnv("MSG_BROKER_CODEC", "json"),
+		DeliveryPolicy:  source.getEnv("MSG_BROKER_DELIVERY_POLICY", "best-effort"),
+		ShutdownTimeout: source.getEnvDuration("MSG_BROKER_SHUTDOWN_TIMEOUT", 10*time.Second),
+		Transport:       Transport(source.getEnv("REDIS_TRANSPORT", string(TransportPubSub))),
+		Streams: StreamOptions{
+			Group:         source.getEnv("REDIS_STREAM_GROUP", "msg_broker"),
+			Consumer:      source.getEnv("REDIS_STREAM_CONSUMER", defaultConsumerName()),
+			MaxLen:        source.getEnvInt("REDIS_STREAM_MAXLEN", 0),
+			BatchSize:     source.getEnvInt("REDIS_STREAM_BATCH_SIZE", 10),
+			BlockTimeout:  source.getEnvDuration("REDIS_STREAM_BLOCK_TIMEOUT", 5*time.Second),
+			ClaimMinIdle:  source.getEnvDuration("REDIS_STREAM_CLAIM_MIN_IDLE", time.Minute),
+			ClaimInterval: source.getEnvDuration("REDIS_STREAM_CLAIM_INTERVAL", 30*time.Second),
+			MaxDeliveries: int(source.getEnvInt("REDIS_STREAM_MAX_DELIVERIES", 5)),
+		},
+		DeadLetterKey:    source.getEnv("MSG_BROKER_DEAD_LETTER", ""),
+		DeadLetterTarget: DeadLetterTarget(source.getEnv("MSG_BROKER_DEAD_LETTER_TARGET", string(DeadLetterList))),
+		MetricsAddr:      source.getEnv("MSG_BROKER_METRICS_ADDR", ""),
+		Workers:          int(source.getEnvInt("MSG_BROKER_WORKERS", int64(defaultWorkerOptions.Workers))),
+		BufferSize:       int(source.getEnvInt("MSG_BROKER_BUFFER_SIZE", int64(defaultWorkerOptions.BufferSize))),
+		OverflowPolicy:   source.getEnv("MSG_BROKER_OVERFLOW", "block"),
+		SpillScope:       source.getEnv("MSG_BROKER_SPILL_SCOPE", ""),
+		Deduplication: DeduplicationOptions{
+			Window: source.getEnvDuration("MSG_BROKER_DEDUP_WINDOW", 0),
+			Scope:  source.getEnv("MSG_BROKER_DEDUP_SCOPE", ""),
+		},
+		Schedule: ScheduleOptions{
+			Key:          source.getEnv("MSG_BROKER_SCHEDULE_KEY", defaultScheduleOptions.Key),
+			PollInterval: source.getEnvDuration("MSG_BROKER_SCHEDULER_INTERVAL", defaultScheduleOptions.PollInterval),
+			BatchSize:    source.getEnvInt("MSG_BROKER_SCHEDULER_BATCH_SIZE", defaultScheduleOptions.BatchSize),
+			MaxAttempts:  int(source.getEnvInt("MSG_BROKER_SCHEDULER_MAX_ATTEMPTS", int64(defaultScheduleOptions.MaxAttempts))),
+		},
+		RunScheduler: source.getEnvBool("MSG_BROKER_SCHEDULER", false),
+		Schemas:      source.getEnvMap("MSG_BROKER_SCHEMAS"),
+		Signing: KeyringOptions{
+			Keys:    source.getEnvMap("MSG_BROKER_SIGNING_KEYS"),
+			Current: source.getEnv("MSG_BROKER_SIGNING_KEY_ID", ""),
+		},
+		Encryption: KeyringOptions{
+			Keys:    source.getEnvMap("MSG_BROKER_ENCRYPTION_KEYS"),
+			Current: source.getEnv("MSG_BROKER_ENCRYPTION_KEY_ID", ""),
+		},
+		EncryptedChannels: splitList(source.getEnv("MSG_BROKER_ENCRYPTED_CHANNELS", "")),
+		Reconnect: ReconnectOptions{
+			MinBackoff:   source.getEnvDuration("REDIS_RECONNECT_MIN_BACKOFF", defaultReconnectOptions.MinBackoff),
+			MaxBackoff:   source.getEnvDuration("REDIS_RECONNECT_MAX_BACKOFF", defaultReconnectOptions.MaxBackoff),
+			MaxAttempts:  int(source.getEnvInt("REDIS_RECONNECT_MAX_ATTEMPTS", 0)),
+			PingInterval: source.getEnvDuration("REDIS_PING_INTERVAL", defaultReconnectOptions.PingInterval),
+		},
+	}
+
+	// Sentinel and cluster modes take a list of seed addresses and fall back
+	// to the single host and port.
+	config.RedisAddrs = splitList(source.getEnv("REDIS_ADDRS", ""))
+	if len(config.RedisAddrs) == 0 {
+		config.RedisAddrs = []string{net.JoinHostPort(config.RedisHost, config.RedisPort)}
+	}
+
+	if err := errors.Join(append(source.errs, config.Validate())...); err != nil {
+		return Config{}, err
 	}
+	return config, nil
 }
 
-func getEnv(key, fallback string) string {
-	value, ok := os.LookupEnv(key)
+// Validate checks values that parse but cannot work, so that a bad
+// deployment fails at startup instead of on the first publish.
+func (c Config) Validate() error {
+	var errs []error
+	switch c.RedisMode {
+	case RedisStandalone:
+	case RedisSentinel:
+		if c.SentinelMaster == "" {
+			errs = append(errs, errors.New("REDIS_SENTINEL_MASTER is required in sentinel mode"))
+		}
+	case RedisCluster:
+		if c.RedisDB != 0 {
+			errs = append(errs, fmt.Errorf("REDIS_DB: cluster mode only supports database 0, got %d", c.RedisDB))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("REDIS_MODE: unknown mode %q", c.RedisMode))
+	}
+	if c.ShardedPubSub && c.RedisMode != RedisCluster {
+		errs = append(errs, errors.New("REDIS_SHARDED_PUBSUB requires REDIS_MODE=cluster"))
+	}
+	if c.RedisHost == "" {
+		errs = append(errs, errors.New("REDIS_HOST must not be empty"))
+	}
+	if port, err := strconv.Atoi(c.RedisPort); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("REDIS_PORT: invalid port %q", c.RedisPort))
+	}
+	if c.RedisDB < 0 {
+		errs = append(errs, fmt.Errorf("REDIS_DB: must not be negative, got %d", c.RedisDB))
+	}
+	if c.RedisUsername != "" && c.RedisPassword == "" {
+		errs = append(errs, errors.New("REDIS_USERNAME requires REDIS_PASSWORD"))
+	}
+	if c.TLS.CAFile != "" {
+		if !c.TLS.Enabled {
+			errs = append(errs, errors.New("REDIS_TLS_CA_FILE is set but REDIS_TLS is disabled"))
+		} else if _, err := os.Stat(c.TLS.CAFile); err != nil {
+			errs = append(errs, fmt.Errorf("REDIS_TLS_CA_FILE: %w", err))
+		}
+	}
+	for channel, path := range c.Schemas {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("MSG_BROKER_SCHEMAS: channel %s: %w", channel, err))
+		}
+	}
+	if codec, err := CodecByName(c.Codec); err == nil && len(c.Schemas) > 0 && !schemaSupports(codec.ContentType()) {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_SCHEMAS: %w (MSG_BROKER_CODEC=%s)", ErrSchemaCodec, c.Codec))
+	}
+	if _, err := c.Signing.Keyring(); err != nil {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_SIGNING_KEYS: %w", err))
+	}
+	if _, err := c.Encryption.Keyring(); err != nil {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_ENCRYPTION_KEYS: %w", err))
+	}
+	for id, encoded := range c.Encryption.Keys {
+		if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			errs = append(errs, fmt.Errorf("MSG_BROKER_ENCRYPTION_KEYS: key %s must be 16, 24 or 32 bytes, got %d", id, len(key)))
+		}
+	}
+	if len(c.EncryptedChannels) > 0 && len(c.Encryption.Keys) == 0 {
+		errs = append(errs, errors.New("MSG_BROKER_ENCRYPTED_CHANNELS requires MSG_BROKER_ENCRYPTION_KEYS"))
+	}
+	if c.Pool.Size < 0 {
+		errs = append(errs, fmt.Errorf("REDIS_POOL_SIZE: must not be negative, got %d", c.Pool.Size))
+	}
+	for name, timeout := range map[string]time.Duration{
+		"REDIS_DIAL_TIMEOUT":  c.Pool.DialTimeout,
+		"REDIS_READ_TIMEOUT":  c.Pool.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": c.Pool.WriteTimeout,
+	} {
+		if timeout <= 0 {
+			errs = append(errs, fmt.Errorf("%s: must be positive, got %s", name, timeout))
+		}
+	}
+	if _, err := CodecByName(c.Codec); err != nil {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_CODEC: %w", err))
+	}
+	if _, err := ParseDeliveryPolicy(c.DeliveryPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_DELIVERY_POLICY: %w", err))
+	}
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_WORKERS: must be at least 1, got %d", c.Workers))
+	}
+	if c.BufferSize < 1 {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_BUFFER_SIZE: must be at least 1, got %d", c.BufferSize))
+	}
+	if _, err := ParseOverflowPolicy(c.OverflowPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_OVERFLOW: %w", err))
+	}
+	if c.Schedule.Key == "" {
+		errs = append(errs, errors.New("MSG_BROKER_SCHEDULE_KEY: must not be empty"))
+	} else if c.RedisMode == RedisCluster && !hasHashTag(c.Schedule.Key) {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_SCHEDULE_KEY: %q needs a {...} hash tag in cluster mode", c.Schedule.Key))
+	}
+	if c.Schedule.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_SCHEDULER_INTERVAL: must be positive, got %s", c.Schedule.PollInterval))
+	}
+	if c.Schedule.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_SCHEDULER_BATCH_SIZE: must be at least 1, got %d", c.Schedule.BatchSize))
+	}
+	if c.Schedule.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_SCHEDULER_MAX_ATTEMPTS: must be at least 1, got %d", c.Schedule.MaxAttempts))
+	}
+	if c.Deduplication.Window < 0 {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_DEDUP_WINDOW: must not be negative, got %s", c.Deduplication.Window))
+	}
+	if c.Transport != TransportPubSub && c.Transport != TransportStreams {
+		errs = append(errs, fmt.Errorf("REDIS_TRANSPORT: unknown transport %q", c.Transport))
+	}
+	if c.DeadLetterTarget != DeadLetterList && c.DeadLetterTarget != DeadLetterChannel {
+		errs = append(errs, fmt.Errorf("MSG_BROKER_DEAD_LETTER_TARGET: unknown target %q", c.DeadLetterTarget))
+	}
+	return errors.Join(errs...)
+}
+
+// parseRedisURL fills host, port, credentials, DB and TLS from a
+// redis:// or rediss:// URL.
+func parseRedisURL(rawURL string, config *Config) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		config.TLS.Enabled = true
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if host := u.Hostname(); host != "" {
+		config.RedisHost = host
+	}
+	if port := u.Port(); port != "" {
+		config.RedisPort = port
+	}
+	if u.User != nil {
+		// redis://:password@host has no user; redis://password@host is
+		// accepted too, as go-redis and redis-cli do.
+		if password, ok := u.User.Password(); ok {
+			config.RedisUsername = u.User.Username()
+			config.RedisPassword = password
+		} else {
+			config.RedisPassword = u.User.Username()
+		}
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		db, err := strconv.Atoi(path)
+		if err != nil {
+			return fmt.Errorf("invalid database %q", path)
+		}
+		config.RedisDB = db
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("MSG_BROKER_CONFIG: %w", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNumber)
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("MSG_BROKER_CONFIG: %w", err)
+	}
+	return values, nil
+}
+
+// configSource looks keys up in the environment, then the config file, and
+// collects parse errors instead of silently falling back to defaults.
+type configSource struct {
+	file map[string]string
+	errs []error
+}
+
+func (s *configSource) lookup(key string) (string, bool) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true
+	}
+	value, ok := s.file[key]
+	return value, ok
+}
+
+func (s *configSource) getEnv(key, fallback string) string {
+	value, ok := s.lookup(key)
 	if !ok {
 		return fallback
 	}
 	return value
 }
+
+func (s *configSource) getEnvInt(key string, fallback int64) int64 {
+	value, ok := s.lookup(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: invalid integer %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (s *configSource) getEnvBool(key string, fallback bool) bool {
+	value, ok := s.lookup(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: invalid boolean %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func (s *configSource) getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := s.lookup(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: invalid duration %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvMap parses a comma-separated list of key=value pairs.
+func (s *configSource) getEnvMap(key string) map[string]string {
+	value, _ := s.lookup(key)
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil
+	}
+	parsed := make(map[string]string, len(items))
+	for _, item := range items {
+		name, target, ok := strings.Cut(item, "=")
+		name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+		if !ok || name == "" || target == "" {
+			s.errs = append(s.errs, fmt.Errorf("%s: invalid entry %q, expected key=value", key, item))
+			continue
+		}
+		parsed[name] = target
+	}
+	return parsed
+}
+
+// defaultConsumerName is the hostname, which stays the same across
+// restarts, so a restarted consumer drains the pending entries it left
+// behind instead of joining the group under a new name.
+func defaultConsumerName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "consumer"
+	}
+	return hostname
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrDeadLetterNotStored = errors.New("dead letters sent to a channel cannot be inspected")
+
+type DeadLetterTarget string
+
+const (
+	DeadLetterList    DeadLetterTarget = "list"
+	DeadLetterChannel DeadLetterTarget = "channel"
+)
+
+type DeadLetter struct {
+	MessageID string    `json:"message_id,omitempty"`
+	Channel   string    `json:"channel"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// DeadLetterQueue collects messages a consumer could not decode or handle,
+// either in a list (inspectable) or on a channel for live monitoring.
+type DeadLetterQueue struct {
+	broker Broker
+	key    string
+	target DeadLetterTarget
+}
+
+func NewDeadLetterQueue(broker Broker, key string, target DeadLetterTarget) *DeadLetterQueue {
+	return &DeadLetterQueue{broker: broker, key: key, target: target}
+}
+
+func (q *DeadLetterQueue) lists() (ListBroker, error) {
+	if q.target != DeadLetterList {
+		return nil, ErrDeadLetterNotStored
+	}
+	return listBroker(q.broker)
+}
+
+func (q *DeadLetterQueue) Send(ctx context.Context, letter DeadLetter) error {
+	serializedLetter, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	if q.target == DeadLetterChannel {
+		_, err := q.broker.Publish(ctx, q.key, serializedLetter)
+		return err
+	}
+	lists, err := q.lists()
+	if err != nil {
+		return err
+	}
+	return lists.Push(ctx, q.key, serializedLetter)
+}
+
+func (q *DeadLetterQueue) Len(ctx context.Context) (int64, error) {
+	lists, err := q.lists()
+	if err != nil {
+		return 0, err
+	}
+	return lists.Len(ctx, q.key)
+}
+
+// Inspect returns up to count dead letters, oldest first, without removing
+// them.
+func (q *DeadLetterQueue) Inspect(ctx context.Context, start, count int64) ([]DeadLetter, error) {
+	lists, err := q.lists()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := lists.Range(ctx, q.key, start, start+count-1)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(values))
+	for _, value := range values {
+		var letter DeadLetter
+		if err := json.Unmarshal(value, &letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// Republish removes up to count of the oldest dead letters and publishes
+// their original payloads to the channels they failed on. It returns how
+// many were republished.
+func (q *DeadLetterQueue) Republish(ctx context.Context, publisher *MessagePublisher, count int) (int, error) {
+	lists, err := q.lists()
+	if err != nil {
+		return 0, err
+	}
+
+	for republished := 0; republished < count; republished++ {
+		// Peek first and only pop once published, so a failed publish
+		// leaves the letter where it was.
+		values, err := lists.Range(ctx, q.key, 0, 0)
+		if err != nil {
+			return republished, err
+		}
+		if len(values) == 0 {
+			return republished, nil
+		}
+
+		var letter DeadLetter
+		if err := json.Unmarshal(values[0], &letter); err != nil {
+			return republished, err
+		}
+		if _, err := publisher.publishPayload(ctx, letter.Channel, []byte(letter.Payload)); err != nil {
+			return republished, err
+		}
+		if _, err := lists.Pop(ctx, q.key); err != nil {
+			return republished, err
+		}
+	}
+	return count, nil
+}
+
+func (c *MessageConsumer) SetDeadLetterQueue(queue *DeadLetterQueue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadLetters = queue
+}
+
+func (c *MessageConsumer) sendToDeadLetter(ctx context.Context, delivery Delivery, err error, attempts int) {
+	c.mu.RLock()
+	queue := c.deadLetters
+	c.mu.RUnlock()
+	if queue == nil {
+		return
+	}
+
+	sendErr := queue.Send(ctx, DeadLetter{
+		MessageID: delivery.Envelope.ID,
+		Channel:   delivery.Channel,
+		Payload:   string(delivery.Payload),
+		Error:     err.Error(),
+		Attempts:  attempts,
+		FailedAt:  time.Now().UTC(),
+	})
+	if sendErr != nil {
+		log.Printf("[%s] Failed to dead-letter message: %v", delivery.Channel, sendErr)
+	}
+}
+
+// isPermanent reports errors that retrying the same message cannot fix.
+func isPermanent(err error) bool {
+	var decodeErr *DecodeError
+	var validationErr *ValidationError
+	var securityErr *SecurityError
+	return errors.As(err, &decodeErr) || errors.As(err, &validationErr) || errors.As(err, &securityErr) ||
+		errors.Is(err, ErrNoHandler)
+}
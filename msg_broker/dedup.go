@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// DeduplicationOptions make the consumer skip messages whose envelope ID
+// it has already processed, or is processing, within Window. A zero Window
+// disables deduplication.
+type DeduplicationOptions struct {
+	Window time.Duration
+	// Scope separates consumers that must each see every message, such as
+	// two services subscribed to the same channel. Consumers sharing a
+	// scope handle each message ID once between them.
+	Scope string
+}
+
+func (c *MessageConsumer) SetDeduplication(options DeduplicationOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deduplication = options
+}
+
+func dedupKey(scope, channel, id string) string {
+	return "dedup:" + scope + ":" + channel + ":" + id
+}
+
+var (
+	// ErrInFlight is returned for a duplicate of a message whose first
+	// delivery is still being handled. It is retryable: the streams
+	// transport leaves the entry pending, so the message is not lost if
+	// the first handler fails.
+	ErrInFlight = errors.New("message is already being processed")
+
+	errProcessed = errors.New("message was already processed")
+)
+
+// Deduplication records go from processing to done when the handler
+// succeeds, and are deleted when it fails.
+var (
+	dedupProcessing = []byte("processing")
+	dedupDone       = []byte("done")
+)
+
+// claim records delivery as being processed with SET NX. For a message
+// another delivery already claimed it returns errProcessed, or ErrInFlight
+// while that delivery is still being handled. When the record cannot be
+// written the message is handled anyway, since a duplicate is safer than a
+// loss. The returned finish function marks the message done, or forgets it
+// if handling failed so it can be processed again.
+func (c *MessageConsumer) claim(ctx context.Context, options DeduplicationOptions, delivery Delivery) (func(error), error) {
+	noop := func(error) {}
+	if delivery.Envelope.ID == "" {
+		return noop, nil
+	}
+	keys, err := keyBroker(c.broker)
+	if err != nil {
+		log.Printf("[%s] Deduplication disabled: %v", delivery.Channel, err)
+		return noop, nil
+	}
+
+	key := dedupKey(options.Scope, delivery.Channel, delivery.Envelope.ID)
+	claimed, err := keys.SetNX(ctx, key, dedupProcessing, options.Window)
+	if err != nil {
+		log.Printf("[%s] Failed to record message %s for deduplication: %v", delivery.Channel, delivery.Envelope.ID, err)
+		return noop, nil
+	}
+	if !claimed {
+		state, err := keys.Get(ctx, key)
+		if err == nil && bytes.Equal(state, dedupDone) {
+			return noop, errProcessed
+		}
+		return noop, ErrInFlight
+	}
+	return func(handleErr error) {
+		ctx := context.WithoutCancel(ctx)
+		if handleErr != nil {
+			if err := keys.Delete(ctx, key); err != nil {
+				log.Printf("[%s] Failed to release message %s for redelivery: %v", delivery.Channel, delivery.Envelope.ID, err)
+			}
+			return
+		}
+		if err := keys.Set(ctx, key, dedupDone, options.Window); err != nil {
+			log.Printf("[%s] Failed to mark message %s as processed: %v", delivery.Channel, delivery.Envelope.ID, err)
+		}
+	}, nil
+}
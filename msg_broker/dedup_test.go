@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeduplicationSeparatesInFlightFromDone(t *testing.T) {
+	broker := NewMemoryBroker()
+	consumer := NewMessageConsumer(broker)
+	consumer.SetDeduplication(DeduplicationOptions{Window: time.Minute})
+	consumer.OnError(func(context.Context, Delivery, error) {})
+
+	payload, err := NewMessagePublisher(broker).serialize(Message{Channel: "orders", Data: 1, ID: "order-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := newDelivery("orders", payload)
+	ctx := context.Background()
+
+	calls := 0
+	started := make(chan struct{})
+	release := make(chan error)
+	consumer.Handle("orders", func(context.Context, Delivery) error {
+		calls++
+		if calls == 1 {
+			close(started)
+			return <-release
+		}
+		return nil
+	})
+
+	first := make(chan error, 1)
+	go func() { first <- consumer.dispatch(ctx, delivery) }()
+	<-started
+	if err := consumer.dispatch(ctx, delivery); !errors.Is(err, ErrInFlight) {
+		t.Fatalf("duplicate while in flight: dispatch() = %v, want ErrInFlight", err)
+	}
+
+	// A failed first delivery releases the message for its redelivery.
+	release <- errors.New("temporarily unavailable")
+	if err := <-first; err == nil {
+		t.Fatal("first dispatch succeeded, want the handler error")
+	}
+	if err := consumer.dispatch(ctx, delivery); err != nil {
+		t.Fatalf("redelivery after failure: dispatch() = %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("handler called %d times, want 2", calls)
+	}
+
+	if err := consumer.dispatch(ctx, delivery); err != nil {
+		t.Fatalf("duplicate after success: dispatch() = %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Fatalf("handler called %d times after a processed duplicate, want 2", calls)
+	}
+}
+
+// claimRecordingBroker records the deduplication keys consumers claim.
+type claimRecordingBroker struct {
+	*MemoryBroker
+	claims int
+}
+
+func (b *claimRecordingBroker) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	b.claims++
+	return b.MemoryBroker.SetNX(ctx, key, value, ttl)
+}
+
+func TestDeduplicationIgnoresUnverifiedMessages(t *testing.T) {
+	keys := NewKeyring()
+	keys.Add("k1", []byte("signing secret"))
+	broker := &claimRecordingBroker{MemoryBroker: NewMemoryBroker()}
+	consumer := NewMessageConsumer(broker)
+	consumer.SetSigningKeys(keys)
+	consumer.SetDeduplication(DeduplicationOptions{Window: time.Minute})
+	consumer.OnError(func(context.Context, Delivery, error) {})
+	handled := 0
+	consumer.Handle("payments", func(context.Context, Delivery) error {
+		handled++
+		return nil
+	})
+
+	forged, err := NewMessagePublisher(broker).serialize(Message{Channel: "payments", Data: 1, ID: "payment-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewMessagePublisher(broker)
+	signer.SetSigningKeys(keys)
+	genuine, err := signer.serialize(Message{Channel: "payments", Data: 1, ID: "payment-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var securityErr *SecurityError
+	if err := consumer.dispatch(ctx, newDelivery("payments", forged)); !errors.As(err, &securityErr) {
+		t.Fatalf("forged message: dispatch() = %v, want a SecurityError", err)
+	}
+	// A forged message must not even briefly hold the genuine message's ID.
+	if broker.claims != 0 {
+		t.Fatalf("forged message claimed its ID %d times", broker.claims)
+	}
+	if err := consumer.dispatch(ctx, newDelivery("payments", genuine)); err != nil || handled != 1 {
+		t.Fatalf("genuine message: dispatch() = %v with %d handled, want it handled", err, handled)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var ErrNoSubscribers = errors.New("no subscribers received the message")
+
+// DeliveryPolicy decides what happens to a PUBLISH that reached nobody. It
+// does not apply to the streams transport, which always stores messages.
+type DeliveryPolicy int
+
+const (
+	// DeliverBestEffort drops the message, matching plain PUBLISH.
+	DeliverBestEffort DeliveryPolicy = iota
+	// DeliverRequireSubscribers reports ErrNoSubscribers to the caller.
+	DeliverRequireSubscribers
+	// DeliverFallbackToList parks the message in a Redis list until a
+	// consumer drains it with DrainFallback.
+	DeliverFallbackToList
+)
+
+func ParseDeliveryPolicy(name string) (DeliveryPolicy, error) {
+	switch name {
+	case "best-effort", "":
+		return DeliverBestEffort, nil
+	case "require-subscribers":
+		return DeliverRequireSubscribers, nil
+	case "fallback-list":
+		return DeliverFallbackToList, nil
+	}
+	return DeliverBestEffort, fmt.Errorf("unknown delivery policy %q", name)
+}
+
+func fallbackKey(channel string) string {
+	return "fallback:" + channel
+}
+
+func (p *MessagePublisher) SetDeliveryPolicy(policy DeliveryPolicy) {
+	p.policy = policy
+}
+
+func (p *MessagePublisher) applyDeliveryPolicy(ctx context.Context, channel string, payload []byte, receivers int64) error {
+	if receivers > 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case DeliverRequireSubscribers:
+		return ErrNoSubscribers
+	case DeliverFallbackToList:
+		lists, err := listBroker(p.broker)
+		if err != nil {
+			return err
+		}
+		return lists.Push(ctx, fallbackKey(channel), payload)
+	}
+	return nil
+}
+
+// DrainFallback hands messages parked by DeliverFallbackToList to the
+// channel's handler, oldest first, and returns how many were handled.
+func (c *MessageConsumer) DrainFallback(ctx context.Context, channel string) (int, error) {
+	lists, err := listBroker(c.broker)
+	if err != nil {
+		return 0, err
+	}
+
+	drained := 0
+	for ctx.Err() == nil {
+		payload, err := lists.Pop(ctx, fallbackKey(channel))
+		if err == ErrListEmpty {
+			return drained, nil
+		}
+		if err != nil {
+			return drained, err
+		}
+
+		delivery := newDelivery(channel, payload)
+		if err := c.dispatch(ctx, delivery); err != nil && err != ErrInFlight {
+			c.sendToDeadLetter(ctx, delivery, err, 1)
+		}
+		drained++
+	}
+	return drained, ctx.Err()
+}
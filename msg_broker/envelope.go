@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+const ContentTypeJSON = "application/json"
+
+// Envelope is the wire format of every message. Payloads published before
+// envelopes existed are bare JSON and are wrapped on receipt, see
+// decodeEnvelope.
+type Envelope struct {
+	ID            string            `json:"id"`
+	ProducedAt    time.Time         `json:"produced_at"`
+	Producer      string            `json:"producer,omitempty"`
+	ContentType   string            `json:"content_type"`
+	SchemaVersion int               `json:"schema_version"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Data          json.RawMessage   `json:"data"`
+	// EncryptionKeyID is set while Data holds an encrypted payload.
+	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
+	// KeyID names the signing key of Signature, an HMAC-SHA256 over the
+	// other fields and the channel.
+	KeyID     string `json:"key_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// setPayload stores an encoded payload. JSON payloads are embedded as-is so
+// the envelope stays readable; other codecs are stored base64 encoded.
+func (e *Envelope) setPayload(codec Codec, payload []byte) error {
+	e.ContentType = codec.ContentType()
+	if e.ContentType == ContentTypeJSON {
+		e.Data = payload
+		return nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	e.Data = data
+	return nil
+}
+
+// Payload returns the payload as produced by the envelope's codec.
+func (e Envelope) Payload() ([]byte, error) {
+	if e.EncryptionKeyID != "" {
+		return nil, ErrEncryptedPayload
+	}
+	if e.ContentType == ContentTypeJSON {
+		return e.Data, nil
+	}
+
+	var payload []byte
+	if err := json.Unmarshal(e.Data, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Decode unmarshals the payload into v with the codec named by the
+// envelope's content type.
+func (e Envelope) Decode(v interface{}) error {
+	codec, err := codecForContentType(e.ContentType)
+	if err != nil {
+		return err
+	}
+	payload, err := e.Payload()
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(payload, v)
+}
+
+func newMessageID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(id)
+}
+
+func decodeEnvelope(payload []byte) Envelope {
+	var envelope Envelope
+	err := json.Unmarshal(payload, &envelope)
+	if err == nil && envelope.ID != "" && envelope.ContentType != "" && envelope.Data != nil {
+		return envelope
+	}
+	return Envelope{ContentType: ContentTypeJSON, Data: payload}
+}
+
+func newDelivery(channel string, payload []byte) Delivery {
+	return Delivery{
+		Channel:  channel,
+		Payload:  payload,
+		Envelope: decodeEnvelope(payload),
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	ErrNoHandler           = errors.New("no handler registered for channel")
+	ErrPatternsUnsupported = errors.New("pattern subscriptions are not supported by the streams transport")
+)
+
+type Delivery struct {
+	Channel string
+	// Pattern is set when the message arrived through a pattern
+	// subscription registered with HandlePattern.
+	Pattern  string
+	Payload  []byte
+	Envelope Envelope
+}
+
+type Handler func(ctx context.Context, delivery Delivery) error
+
+type ErrorHandler func(ctx context.Context, delivery Delivery, err error)
+
+type DecodeError struct {
+	Channel string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("[%s] failed to decode message: %v", e.Channel, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type deliveryContextKey struct{}
+
+// TypedHandler adapts a function taking a concrete payload type into a
+// Handler, decoding the message before calling it.
+func TypedHandler[T any](fn func(context.Context, T) error) Handler {
+	return func(ctx context.Context, delivery Delivery) error {
+		var value T
+		if err := delivery.Envelope.Decode(&value); err != nil {
+			return &DecodeError{Channel: delivery.Channel, Err: err}
+		}
+		return fn(ctx, value)
+	}
+}
+
+// DeliveryFromContext returns the delivery being handled, including its
+// envelope, for handlers that only receive the decoded payload.
+func DeliveryFromContext(ctx context.Context) (Delivery, bool) {
+	delivery, ok := ctx.Value(deliveryContextKey{}).(Delivery)
+	return delivery, ok
+}
+
+func logError(ctx context.Context, delivery Delivery, err error) {
+	log.Printf("[%s] Failed to handle message: %v", delivery.Channel, err)
+}
+
+func (c *MessageConsumer) Handle(channel string, handler Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[channel] = handler
+}
+
+// HandlePattern registers a handler for every channel matching a glob-style
+// pattern such as "orders.*". Patterns are subscribed to by Start; the
+// matched channel is available as Delivery.Channel.
+func (c *MessageConsumer) HandlePattern(pattern string, handler Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.patternHandlers[pattern] = handler
+}
+
+func (c *MessageConsumer) patterns() []string {
+	patterns := make([]string, 0, len(c.patternHandlers))
+	for pattern := range c.patternHandlers {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+func (c *MessageConsumer) OnError(handler ErrorHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errorHandler = handler
+}
+
+func (c *MessageConsumer) dispatch(ctx context.Context, delivery Delivery) error {
+	c.mu.RLock()
+	handler, ok := c.handlers[delivery.Channel]
+	if delivery.Pattern != "" {
+		handler, ok = c.patternHandlers[delivery.Pattern]
+	}
+	if ok {
+		handler = c.wrap(handler)
+	}
+	errorHandler := c.errorHandler
+	metrics := c.metrics
+	tracer := c.tracer
+	deduplication := c.deduplication
+	schema, hasSchema := c.schemas[delivery.Channel]
+	if !hasSchema && delivery.Pattern != "" {
+		schema = c.schemas[delivery.Pattern]
+	}
+	signingKeys := c.signingKeys
+	encryptionKeys, encrypted := c.encryption[delivery.Channel]
+	if !encrypted && delivery.Pattern != "" {
+		encryptionKeys = c.encryption[delivery.Pattern]
+	}
+	c.mu.RUnlock()
+
+	err := ErrNoHandler
+	if ok {
+		spanCtx, span := startConsumeSpan(ctx, tracer, delivery)
+		start := time.Now()
+		// Only a verified message may claim its ID for deduplication, or a
+		// forged copy reusing the ID would shadow the genuine one.
+		delivery, err = openDelivery(delivery, signingKeys, encryptionKeys)
+		if err == nil && deduplication.Window > 0 {
+			finish, duplicate := c.claim(ctx, deduplication, delivery)
+			if duplicate != nil {
+				log.Printf("[%s] Skipping duplicate message %s: %v", delivery.Channel, delivery.Envelope.ID, duplicate)
+				metrics.observeDuplicate(delivery.Channel)
+				span.End()
+				if duplicate == ErrInFlight {
+					return duplicate
+				}
+				return nil
+			}
+			defer func() { finish(err) }()
+		}
+		if err == nil {
+			err = validateDelivery(schema, delivery)
+		}
+		if err == nil {
+			err = handler(context.WithValue(spanCtx, deliveryContextKey{}, delivery), delivery)
+		}
+		metrics.observeDispatch(delivery.Channel, time.Since(start), err)
+		endSpan(span, err)
+	}
+	if err != nil {
+		errorHandler(ctx, delivery, err)
+	}
+	return err
+}
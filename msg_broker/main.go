@@ -2,41 +2,208 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
-	config := LoadConfig()
+	if len(os.Args) > 1 || filepath.Base(os.Args[0]) == "msgctl" {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	redisClient := NewRedis(config)
-	defer redisClient.RedisClient.Close()
+	redisClient, err := NewRedis(config)
+	if err != nil {
+		log.Fatalf("Failed to create Redis client: %v", err)
+	}
+	defer redisClient.Close()
 
-	publisher := NewMessagePublisher(redisClient)
+	publisher, err := newPublisher(config, redisClient)
+	if err != nil {
+		log.Fatalf("Invalid publisher configuration: %v", err)
+	}
+	subscriber, err := newConsumer(config, redisClient)
+	if err != nil {
+		log.Fatalf("Invalid consumer configuration: %v", err)
+	}
+	subscriber.OnHealthChange(func(state HealthState) {
+		log.Printf("Consumer health changed: %s", state)
+	})
+	if config.MetricsAddr != "" {
+		metrics := NewMetrics(prometheus.DefaultRegisterer)
+		publisher.SetMetrics(metrics)
+		subscriber.SetMetrics(metrics)
+		metricsServer := ServeMetrics(config.MetricsAddr)
+		defer metricsServer.Close()
+	}
 
-	subscriber := NewMessageConsumer(redisClient)
+	channels := []string{"channel1", "channel2", "channel3", "channel4", "channel5"}
+	printMessage := TypedHandler(func(ctx context.Context, data interface{}) error {
+		delivery, _ := DeliveryFromContext(ctx)
+		fmt.Printf("[%s] Received message %s from %q: %+v\n", delivery.Channel, delivery.Envelope.ID, delivery.Envelope.Producer, data)
+		return nil
+	})
+	for _, channel := range channels {
+		subscriber.Handle(channel, printMessage)
+	}
 
-	go subscriber.ConsumerMessages(ctx, []string{"channel1", "channel2", "channel3", "channel4", "channel5"})
+	if err := subscriber.Start(ctx, channels); err != nil {
+		log.Fatalf("Failed to start consumer: %v", err)
+	}
+	if policy, _ := ParseDeliveryPolicy(config.DeliveryPolicy); policy == DeliverFallbackToList {
+		for _, channel := range channels {
+			if _, err := subscriber.DrainFallback(ctx, channel); err != nil {
+				log.Printf("[%s] Failed to drain fallback list: %v", channel, err)
+			}
+		}
+	}
 
 	// Publish messages to multiple channels
-	publisher.PublishMessages(ctx, Message{Channel: "channel1", Data: "Hello, Redis!"})
-	
-	// Publish multiple messages to channel1
-	publisher.PublishMessages(ctx, Message{Channel: "channel1", Data: map[string]string{"message": "Hello from channel1 - Message 1"}})
-	publisher.PublishMessages(ctx, Message{Channel: "channel1", Data: map[string]string{"message": "Hello from channel1 - Message 2"}})
+	receivers, err := publisher.PublishMessages(ctx, Message{Channel: "channel1", Data: "Hello, Redis!"})
+	if err != nil {
+		log.Printf("[channel1] Failed to publish message: %v", err)
+	} else {
+		log.Printf("[channel1] Message delivered to %d subscriber(s)", receivers)
+	}
 
-	publisher.PublishMessages(ctx, Message{Channel: "channel2", Data: map[string]string{"message": "Hello from channel2"}})
-	publisher.PublishMessages(ctx, Message{Channel: "channel4", Data: map[string]string{"message": "Hello from channel3"}})
-	publisher.PublishMessages(ctx, Message{Channel: "channel4", Data: map[string]string{"message": "Hello from channel4"}})
-	publisher.PublishMessages(ctx, Message{Channel: "channel5", Data: map[string]string{"message": "Hello from channel5"}})
+	// Publish the remaining messages in a single round-trip
+	results := publisher.PublishBatch(ctx, []Message{
+		{Channel: "channel1", Data: map[string]string{"message": "Hello from channel1 - Message 1"}},
+		{Channel: "channel1", Data: map[string]string{"message": "Hello from channel1 - Message 2"}},
+		{Channel: "channel2", Data: map[string]string{"message": "Hello from channel2"}},
+		{Channel: "channel4", Data: map[string]string{"message": "Hello from channel3"}},
+		{Channel: "channel4", Data: map[string]string{"message": "Hello from channel4"}},
+		{Channel: "channel5", Data: map[string]string{"message": "Hello from channel5"}},
+	})
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("[%s] Failed to publish message: %v", result.Message.Channel, result.Err)
+		}
+	}
+
+	if config.RunScheduler {
+		go func() {
+			if err := publisher.RunScheduler(ctx); err != nil {
+				log.Printf("[scheduler] Stopped: %v", err)
+			}
+		}()
+	}
+	if _, err := publisher.PublishAfter(ctx, Message{Channel: "channel3", Data: "Hello from the future"}, 15*time.Second); err != nil {
+		log.Printf("[channel3] Failed to schedule message: %v", err)
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down...")
+	cancel()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer shutdownCancel()
+	if err := subscriber.Stop(shutdownCtx); err != nil {
+		log.Printf("Consumer did not drain in time: %v", err)
+	}
+}
+
+// newPublisher builds the publisher described by config, shared by the demo
+// and msgctl.
+func newPublisher(config Config, redisClient Redis) (*MessagePublisher, error) {
+	publisher := NewMessagePublisher(redisClient)
+	if config.Transport == TransportStreams {
+		publisher = NewStreamPublisher(redisClient, config.Streams)
+	}
+	publisher.SetProducer(config.Producer)
+	codec, err := CodecByName(config.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("MSG_BROKER_CODEC: %w", err)
+	}
+	publisher.SetCodec(codec)
+	policy, err := ParseDeliveryPolicy(config.DeliveryPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("MSG_BROKER_DELIVERY_POLICY: %w", err)
+	}
+	publisher.SetDeliveryPolicy(policy)
+	publisher.SetScheduleOptions(config.Schedule)
+	schemas, err := loadSchemas(config.Schemas)
+	if err != nil {
+		return nil, err
+	}
+	for channel, schema := range schemas {
+		publisher.SetChannelSchema(channel, schema)
+	}
+	signingKeys, encryptionKeys, err := loadKeyrings(config)
+	if err != nil {
+		return nil, err
+	}
+	if signingKeys != nil {
+		publisher.SetSigningKeys(signingKeys)
+	}
+	for _, channel := range config.EncryptedChannels {
+		publisher.SetChannelEncryption(channel, encryptionKeys)
+	}
+	return publisher, nil
+}
+
+func loadKeyrings(config Config) (signing, encryption *Keyring, err error) {
+	if signing, err = config.Signing.Keyring(); err != nil {
+		return nil, nil, fmt.Errorf("MSG_BROKER_SIGNING_KEYS: %w", err)
+	}
+	if encryption, err = config.Encryption.Keyring(); err != nil {
+		return nil, nil, fmt.Errorf("MSG_BROKER_ENCRYPTION_KEYS: %w", err)
+	}
+	return signing, encryption, nil
+}
+
+func newConsumer(config Config, redisClient Redis) (*MessageConsumer, error) {
+	subscriber := NewMessageConsumer(redisClient)
+	if config.Transport == TransportStreams {
+		subscriber = NewStreamConsumer(redisClient, config.Streams)
+	}
+	subscriber.SetReconnectOptions(config.Reconnect)
+	overflow, err := ParseOverflowPolicy(config.OverflowPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("MSG_BROKER_OVERFLOW: %w", err)
+	}
+	subscriber.SetWorkerOptions(WorkerOptions{
+		Workers:    config.Workers,
+		BufferSize: config.BufferSize,
+		Overflow:   overflow,
+		Scope:      config.SpillScope,
+	})
+	subscriber.SetDeduplication(config.Deduplication)
+	schemas, err := loadSchemas(config.Schemas)
+	if err != nil {
+		return nil, err
+	}
+	for channel, schema := range schemas {
+		subscriber.SetChannelSchema(channel, schema)
+	}
+	signingKeys, encryptionKeys, err := loadKeyrings(config)
+	if err != nil {
+		return nil, err
+	}
+	if signingKeys != nil {
+		subscriber.SetSigningKeys(signingKeys)
+	}
+	for _, channel := range config.EncryptedChannels {
+		subscriber.SetChannelEncryption(channel, encryptionKeys)
+	}
+	if config.DeadLetterKey != "" {
+		subscriber.SetDeadLetterQueue(NewDeadLetterQueue(redisClient, config.DeadLetterKey, config.DeadLetterTarget))
+	}
+	return subscriber, nil
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is an in-process Broker with Redis pub/sub semantics, meant
+// for unit-testing code built on MessagePublisher and MessageConsumer
+// without a Redis server.
+type MemoryBroker struct {
+	mu            sync.RWMutex
+	subscriptions map[*memorySubscription]struct{}
+	lists         map[string][][]byte
+	keys          map[string]memoryKey
+	scheduled     map[string]map[string]scheduledEntry
+	closed        bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscriptions: make(map[*memorySubscription]struct{}),
+		lists:         make(map[string][][]byte),
+		keys:          make(map[string]memoryKey),
+		scheduled:     make(map[string]map[string]scheduledEntry),
+	}
+}
+
+// Publish counts one receiver per matching channel or pattern subscription,
+// like PUBLISH does.
+func (b *MemoryBroker) Publish(ctx context.Context, channel string, payload []byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return 0, ErrBrokerClosed
+	}
+
+	var receivers int64
+	for subscription := range b.subscriptions {
+		receivers += subscription.deliver(channel, payload)
+	}
+	return receivers, nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, channels ...string) (Subscription, error) {
+	return b.subscribe(ctx, channels, nil)
+}
+
+func (b *MemoryBroker) PSubscribe(ctx context.Context, patterns ...string) (Subscription, error) {
+	return b.subscribe(ctx, nil, patterns)
+}
+
+func (b *MemoryBroker) subscribe(ctx context.Context, channels, patterns []string) (Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	subscription := &memorySubscription{
+		broker:   b,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		notify:   make(chan struct{}, 1),
+	}
+	for _, channel := range channels {
+		subscription.channels[channel] = struct{}{}
+	}
+	for _, pattern := range patterns {
+		subscription.patterns[pattern] = struct{}{}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+	b.subscriptions[subscription] = struct{}{}
+	return subscription, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	subscriptions := b.subscriptions
+	b.subscriptions = make(map[*memorySubscription]struct{})
+	b.closed = true
+	b.mu.Unlock()
+
+	for subscription := range subscriptions {
+		subscription.close()
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Push(ctx context.Context, key string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lists[key] = append(b.lists[key], append([]byte(nil), payload...))
+	return nil
+}
+
+func (b *MemoryBroker) Pop(ctx context.Context, key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := b.lists[key]
+	if len(list) == 0 {
+		return nil, ErrListEmpty
+	}
+	b.lists[key] = list[1:]
+	return list[0], nil
+}
+
+// Range follows LRANGE, including negative indexes counted from the end.
+func (b *MemoryBroker) Range(ctx context.Context, key string, start, stop int64) ([][]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	list := b.lists[key]
+	length := int64(len(list))
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return [][]byte{}, nil
+	}
+	return append([][]byte(nil), list[start:stop+1]...), nil
+}
+
+func (b *MemoryBroker) Len(ctx context.Context, key string) (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return int64(len(b.lists[key])), nil
+}
+
+type memoryKey struct {
+	value  []byte
+	expiry time.Time
+}
+
+func (k memoryKey) live(now time.Time) bool {
+	return k.expiry.IsZero() || now.Before(k.expiry)
+}
+
+// Expired keys are replaced or dropped lazily.
+func (b *MemoryBroker) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if existing, ok := b.keys[key]; ok && existing.live(now) {
+		return false, nil
+	}
+	b.setKeyLocked(key, value, ttl, now)
+	return true, nil
+}
+
+func (b *MemoryBroker) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setKeyLocked(key, value, ttl, time.Now())
+	return nil
+}
+
+func (b *MemoryBroker) setKeyLocked(key string, value []byte, ttl time.Duration, now time.Time) {
+	stored := memoryKey{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		stored.expiry = now.Add(ttl)
+	}
+	b.keys[key] = stored
+}
+
+func (b *MemoryBroker) Get(ctx context.Context, key string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if stored, ok := b.keys[key]; ok && stored.live(time.Now()) {
+		return append([]byte(nil), stored.value...), nil
+	}
+	return nil, nil
+}
+
+func (b *MemoryBroker) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.keys, key)
+	return nil
+}
+
+type scheduledEntry struct {
+	due     time.Time
+	payload []byte
+}
+
+func (b *MemoryBroker) Schedule(ctx context.Context, key, id string, due time.Time, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries, ok := b.scheduled[key]
+	if !ok {
+		entries = make(map[string]scheduledEntry)
+		b.scheduled[key] = entries
+	}
+	entries[id] = scheduledEntry{due: due, payload: append([]byte(nil), payload...)}
+	return nil
+}
+
+func (b *MemoryBroker) PopDue(ctx context.Context, key string, until time.Time, limit int64) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := b.scheduled[key]
+	var due []string
+	for id, entry := range entries {
+		if !entry.due.After(until) {
+			due = append(due, id)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return entries[due[i]].due.Before(entries[due[j]].due)
+	})
+	if int64(len(due)) > limit {
+		due = due[:limit]
+	}
+
+	payloads := make([][]byte, len(due))
+	for i, id := range due {
+		payloads[i] = entries[id].payload
+		delete(entries, id)
+	}
+	return payloads, nil
+}
+
+func (b *MemoryBroker) Unschedule(ctx context.Context, key, id string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.scheduled[key][id]
+	delete(b.scheduled[key], id)
+	return ok, nil
+}
+
+type memorySubscription struct {
+	broker   *MemoryBroker
+	mu       sync.Mutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+	queue    []BrokerMessage
+	notify   chan struct{}
+	closed   bool
+}
+
+func (s *memorySubscription) deliver(channel string, payload []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0
+	}
+
+	var receivers int64
+	if _, ok := s.channels[channel]; ok {
+		s.queue = append(s.queue, BrokerMessage{Channel: channel, Payload: payload})
+		receivers++
+	}
+	for pattern := range s.patterns {
+		if globMatch(pattern, channel) {
+			s.queue = append(s.queue, BrokerMessage{Channel: channel, Pattern: pattern, Payload: payload})
+			receivers++
+		}
+	}
+	if receivers > 0 {
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+	return receivers
+}
+
+// Receive ignores pingInterval; an in-process subscription cannot go stale.
+func (s *memorySubscription) Receive(pingInterval time.Duration) (BrokerMessage, error) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			message := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return message, nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return BrokerMessage{}, ErrSubscriptionClosed
+		}
+		s.mu.Unlock()
+		<-s.notify
+	}
+}
+
+func (s *memorySubscription) Subscribe(ctx context.Context, channels ...string) error {
+	return s.update(ctx, s.channels, channels, true)
+}
+
+func (s *memorySubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	return s.update(ctx, s.channels, channels, false)
+}
+
+func (s *memorySubscription) PSubscribe(ctx context.Context, patterns ...string) error {
+	return s.update(ctx, s.patterns, patterns, true)
+}
+
+func (s *memorySubscription) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return s.update(ctx, s.patterns, patterns, false)
+}
+
+func (s *memorySubscription) update(ctx context.Context, set map[string]struct{}, names []string, add bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSubscriptionClosed
+	}
+	for _, name := range names {
+		if add {
+			set[name] = struct{}{}
+		} else {
+			delete(set, name)
+		}
+	}
+	return nil
+}
+
+func (s *memorySubscription) Close() error {
+	s.broker.mu.Lock()
+	delete(s.broker.subscriptions, s)
+	s.broker.mu.Unlock()
+	s.close()
+	return nil
+}
+
+func (s *memorySubscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.notify)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, subscription Subscription) BrokerMessage {
+	t.Helper()
+	received := make(chan BrokerMessage, 1)
+	failed := make(chan error, 1)
+	go func() {
+		message, err := subscription.Receive(time.Second)
+		if err != nil {
+			failed <- err
+			return
+		}
+		received <- message
+	}()
+	select {
+	case message := <-received:
+		return message
+	case err := <-failed:
+		t.Fatalf("Receive() = %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return BrokerMessage{}
+}
+
+func TestMemoryBrokerPublishSubscribe(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx := context.Background()
+
+	receivers, err := broker.Publish(ctx, "orders", []byte("lost"))
+	if err != nil || receivers != 0 {
+		t.Fatalf("Publish() without subscribers = %d, %v; want 0, nil", receivers, err)
+	}
+
+	subscription, err := broker.Subscribe(ctx, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receivers, err = broker.Publish(ctx, "orders", []byte("first"))
+	if err != nil || receivers != 1 {
+		t.Fatalf("Publish() = %d, %v; want 1, nil", receivers, err)
+	}
+	if receivers, _ := broker.Publish(ctx, "payments", []byte("other")); receivers != 0 {
+		t.Fatalf("Publish() on another channel reached %d subscribers", receivers)
+	}
+	message := receive(t, subscription)
+	if message.Channel != "orders" || message.Pattern != "" || string(message.Payload) != "first" {
+		t.Fatalf("received %+v", message)
+	}
+
+	if err := subscription.Unsubscribe(ctx, "orders"); err != nil {
+		t.Fatal(err)
+	}
+	if receivers, _ := broker.Publish(ctx, "orders", []byte("second")); receivers != 0 {
+		t.Fatalf("Publish() after Unsubscribe reached %d subscribers", receivers)
+	}
+	if err := subscription.Subscribe(ctx, "payments"); err != nil {
+		t.Fatal(err)
+	}
+	if receivers, _ := broker.Publish(ctx, "payments", []byte("third")); receivers != 1 {
+		t.Fatalf("Publish() after Subscribe reached %d subscribers, want 1", receivers)
+	}
+	if message := receive(t, subscription); string(message.Payload) != "third" {
+		t.Fatalf("received %q, want third", message.Payload)
+	}
+}
+
+func TestMemoryBrokerPatterns(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx := context.Background()
+
+	subscription, err := broker.PSubscribe(ctx, "orders.*", "orders.?u*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like PUBLISH, every matching pattern counts and gets its own copy.
+	receivers, err := broker.Publish(ctx, "orders.eu", []byte("both"))
+	if err != nil || receivers != 2 {
+		t.Fatalf("Publish() = %d, %v; want 2, nil", receivers, err)
+	}
+	patterns := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		message := receive(t, subscription)
+		if message.Channel != "orders.eu" || string(message.Payload) != "both" {
+			t.Fatalf("received %+v", message)
+		}
+		patterns[message.Pattern] = true
+	}
+	if !patterns["orders.*"] || !patterns["orders.?u*"] {
+		t.Fatalf("received patterns %v, want both", patterns)
+	}
+
+	if receivers, _ := broker.Publish(ctx, "orders", []byte("none")); receivers != 0 {
+		t.Fatalf("Publish() on orders reached %d patterns, want 0", receivers)
+	}
+	if err := subscription.PUnsubscribe(ctx, "orders.?u*"); err != nil {
+		t.Fatal(err)
+	}
+	if receivers, _ := broker.Publish(ctx, "orders.us", []byte("one")); receivers != 1 {
+		t.Fatalf("Publish() after PUnsubscribe reached %d patterns, want 1", receivers)
+	}
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx := context.Background()
+	subscription, err := broker.Subscribe(ctx, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subscription.Receive(time.Second); !errors.Is(err, ErrSubscriptionClosed) {
+		t.Fatalf("Receive() after Close = %v, want ErrSubscriptionClosed", err)
+	}
+	if _, err := broker.Publish(ctx, "orders", nil); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("Publish() after Close = %v, want ErrBrokerClosed", err)
+	}
+	if _, err := broker.Subscribe(ctx, "orders"); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("Subscribe() after Close = %v, want ErrBrokerClosed", err)
+	}
+}
+
+func TestMemoryBrokerRange(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx := context.Background()
+	for _, entry := range []string{"a", "b", "c"} {
+		if err := broker.Push(ctx, "list", []byte(entry)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		start, stop int64
+		want        string
+	}{
+		{0, -1, "abc"},
+		{1, 1, "b"},
+		{-2, -1, "bc"},
+		{0, 10, "abc"},
+		{2, 1, ""},
+	}
+	for _, test := range tests {
+		entries, err := broker.Range(ctx, "list", test.start, test.stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		for _, entry := range entries {
+			got += string(entry)
+		}
+		if got != test.want {
+			t.Errorf("Range(%d, %d) = %q, want %q", test.start, test.stop, got, test.want)
+		}
+	}
+
+	if entry, err := broker.Pop(ctx, "list"); err != nil || string(entry) != "a" {
+		t.Fatalf("Pop() = %q, %v; want a", entry, err)
+	}
+}
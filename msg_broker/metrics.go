@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors for publishers and consumers.
+// A nil *Metrics records nothing, so instrumented code does not need to
+// check whether metrics are enabled.
+type Metrics struct {
+	published           *prometheus.CounterVec
+	publishFailed       *prometheus.CounterVec
+	consumed            *prometheus.CounterVec
+	decodeFailed        *prometheus.CounterVec
+	handlerDuration     *prometheus.HistogramVec
+	activeSubscriptions prometheus.Gauge
+	dropped             *prometheus.CounterVec
+	duplicates          *prometheus.CounterVec
+	invalid             *prometheus.CounterVec
+	rejected            *prometheus.CounterVec
+}
+
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_published_total",
+			Help:      "Messages published successfully.",
+		}, []string{"channel"}),
+		publishFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_publish_failed_total",
+			Help:      "Messages that could not be serialized or published.",
+		}, []string{"channel"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_consumed_total",
+			Help:      "Messages received and dispatched to a handler.",
+		}, []string{"channel"}),
+		decodeFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_decode_failed_total",
+			Help:      "Messages whose payload could not be decoded.",
+		}, []string{"channel"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "msg_broker",
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent in message handlers, including middleware.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"channel"}),
+		activeSubscriptions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "msg_broker",
+			Name:      "active_subscriptions",
+			Help:      "Channel, pattern and stream subscriptions currently being consumed.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_dropped_total",
+			Help:      "Messages discarded because a channel's worker buffer was full.",
+		}, []string{"channel", "reason"}),
+		duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_duplicate_total",
+			Help:      "Messages skipped because their ID was already processed.",
+		}, []string{"channel"}),
+		invalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_invalid_total",
+			Help:      "Messages received that did not match their channel's JSON Schema.",
+		}, []string{"channel"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "msg_broker",
+			Name:      "messages_rejected_total",
+			Help:      "Messages received with a missing or invalid signature or encryption.",
+		}, []string{"channel"}),
+	}
+	registerer.MustRegister(
+		m.published,
+		m.publishFailed,
+		m.consumed,
+		m.decodeFailed,
+		m.handlerDuration,
+		m.activeSubscriptions,
+		m.dropped,
+		m.duplicates,
+		m.invalid,
+		m.rejected,
+	)
+	return m
+}
+
+func (p *MessagePublisher) SetMetrics(metrics *Metrics) {
+	p.metrics = metrics
+}
+
+func (c *MessageConsumer) SetMetrics(metrics *Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = metrics
+}
+
+func (m *Metrics) observePublish(channel string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.publishFailed.WithLabelValues(channel).Inc()
+		return
+	}
+	m.published.WithLabelValues(channel).Inc()
+}
+
+func (m *Metrics) observeDispatch(channel string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.consumed.WithLabelValues(channel).Inc()
+	m.handlerDuration.WithLabelValues(channel).Observe(duration.Seconds())
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		m.decodeFailed.WithLabelValues(channel).Inc()
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		m.invalid.WithLabelValues(channel).Inc()
+	}
+	var securityErr *SecurityError
+	if errors.As(err, &securityErr) {
+		m.rejected.WithLabelValues(channel).Inc()
+	}
+}
+
+func (m *Metrics) subscriptionsChanged(delta int) {
+	if m != nil {
+		m.activeSubscriptions.Add(float64(delta))
+	}
+}
+
+func (m *Metrics) observeDrop(channel, reason string) {
+	if m != nil {
+		m.dropped.WithLabelValues(channel, reason).Inc()
+	}
+}
+
+func (m *Metrics) observeDuplicate(channel string) {
+	if m != nil {
+		m.duplicates.WithLabelValues(channel).Inc()
+	}
+}
+
+// ServeMetrics exposes the default Prometheus registry on addr under
+// /metrics until the returned server is shut down.
+func ServeMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics listener failed: %v", err)
+		}
+	}()
+	return server
+}
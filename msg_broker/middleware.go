@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a Handler. Middlewares registered with Use wrap every
+// channel and pattern handler; the first one registered is the outermost.
+type Middleware func(Handler) Handler
+
+// PublishFunc publishes a single message and reports how many subscribers
+// received it, like PublishMessages.
+type PublishFunc func(ctx context.Context, message Message) (int64, error)
+
+// PublishMiddleware wraps publishing, e.g. to add headers or audit what is
+// sent.
+type PublishMiddleware func(PublishFunc) PublishFunc
+
+type PanicError struct {
+	Channel string
+	Value   interface{}
+	Stack   []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("[%s] handler panicked: %v", e.Channel, e.Value)
+}
+
+// Use adds consumer middleware. Panic recovery is always installed outside
+// of it, so a panicking handler or middleware cannot kill a receive loop.
+func (c *MessageConsumer) Use(middleware ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.middleware = append(c.middleware, middleware...)
+}
+
+func (c *MessageConsumer) wrap(handler Handler) Handler {
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		handler = c.middleware[i](handler)
+	}
+	return Recover()(handler)
+}
+
+// Use adds publisher middleware, applied to PublishMessages, Request and
+// PublishBatch. The first one registered is the outermost.
+func (p *MessagePublisher) Use(middleware ...PublishMiddleware) {
+	p.middleware = append(p.middleware, middleware...)
+}
+
+func (p *MessagePublisher) wrap(publish PublishFunc) PublishFunc {
+	for i := len(p.middleware) - 1; i >= 0; i-- {
+		publish = p.middleware[i](publish)
+	}
+	return publish
+}
+
+// Recover turns a handler panic into a *PanicError carrying the stack, so
+// it flows through the error handler and dead-letter queue like any other
+// failure.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery Delivery) (err error) {
+			defer func() {
+				if value := recover(); value != nil {
+					err = &PanicError{Channel: delivery.Channel, Value: value, Stack: debug.Stack()}
+				}
+			}()
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// Logging logs every handled message with its channel, ID, duration and
+// outcome. A nil logger uses slog.Default().
+func Logging(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery Delivery) error {
+			start := time.Now()
+			err := next(ctx, delivery)
+			attrs := []any{
+				slog.String("channel", delivery.Channel),
+				slog.String("message_id", delivery.Envelope.ID),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if delivery.Pattern != "" {
+				attrs = append(attrs, slog.String("pattern", delivery.Pattern))
+			}
+			if err != nil {
+				logger.ErrorContext(ctx, "message handling failed", append(attrs, slog.Any("error", err))...)
+			} else {
+				logger.InfoContext(ctx, "message handled", attrs...)
+			}
+			return err
+		}
+	}
+}
+
+// Timing reports how long each handler call took, e.g. to feed a metrics
+// histogram.
+func Timing(observe func(delivery Delivery, duration time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery Delivery) error {
+			start := time.Now()
+			err := next(ctx, delivery)
+			observe(delivery, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Timeout gives each handler call a context that is cancelled after
+// timeout. Handlers must watch ctx.Done() for this to take effect.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery Delivery) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, delivery)
+		}
+	}
+}
+
+// Retry calls the handler up to attempts times, waiting with exponential
+// backoff and jitter between calls. Errors that retrying cannot fix, such
+// as decode failures, are returned immediately.
+func Retry(attempts int, minBackoff, maxBackoff time.Duration) Middleware {
+	options := ReconnectOptions{MinBackoff: minBackoff, MaxBackoff: maxBackoff}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery Delivery) error {
+			var err error
+			for attempt := 1; ; attempt++ {
+				if err = next(ctx, delivery); err == nil || isPermanent(err) || attempt >= attempts {
+					return err
+				}
+
+				timer := time.NewTimer(options.backoff(attempt))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return err
+				case <-timer.C:
+				}
+			}
+		}
+	}
+}
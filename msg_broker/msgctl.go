@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const msgctlUsage = `Usage: msgctl <command> [flags] [arguments]
+
+Commands:
+  pub <channel> <json|@file|@->   publish a JSON message
+  sub <channel|pattern>...        print messages as they arrive
+  stats [channel...]              show subscribers, streams, scheduled and dead-lettered messages
+  record <channel|pattern>...     save messages as they arrive to a JSON Lines file
+  replay <file>                   publish a recording again
+
+Configuration is read from the same environment variables (and
+MSG_BROKER_CONFIG file) as the service. Run "msgctl <command> -h" for flags.
+`
+
+// runCLI runs a msgctl command and returns the process exit code. The
+// service binary doubles as msgctl whenever it is given arguments or is
+// named msgctl.
+func runCLI(args []string) int {
+	commands := map[string]func(context.Context, Config, Redis, []string) error{
+		"pub":    runPub,
+		"sub":    runSub,
+		"stats":  runStats,
+		"record": runRecord,
+		"replay": runReplay,
+	}
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, msgctlUsage)
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Print(msgctlUsage)
+		return 0
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "msgctl: unknown command %q\n\n%s", args[0], msgctlUsage)
+		return 2
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "msgctl: invalid configuration:\n%v\n", err)
+		return 1
+	}
+	redisClient, err := NewRedis(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "msgctl: %v\n", err)
+		return 1
+	}
+	defer redisClient.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := command(ctx, config, redisClient, args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "msgctl %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func newFlagSet(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: msgctl %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// headerFlags collects repeated -header key=value flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("header %q is not key=value", value)
+	}
+	h[key] = val
+	return nil
+}
+
+func runPub(ctx context.Context, config Config, redisClient Redis, args []string) error {
+	flags := newFlagSet("pub", "[flags] <channel> <json|@file|@->")
+	id := flags.String("id", "", "message ID (generated if empty)")
+	headers := headerFlags{}
+	flags.Var(headers, "header", "envelope header as key=value (repeatable)")
+	after := flags.Duration("after", 0, "schedule the message this far in the future")
+	at := flags.String("at", "", "schedule the message at an RFC 3339 time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("expected a channel and a message")
+	}
+
+	data, err := readMessageData(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	publisher, err := newPublisher(config, redisClient)
+	if err != nil {
+		return err
+	}
+	message := Message{Channel: flags.Arg(0), Data: data, ID: *id}
+	if message.ID == "" {
+		message.ID = newMessageID()
+	}
+	if len(headers) > 0 {
+		message.Headers = headers
+	}
+
+	switch {
+	case *at != "":
+		due, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid -at: %w", err)
+		}
+		if _, err := publisher.PublishAt(ctx, message, due); err != nil {
+			return err
+		}
+		fmt.Printf("Scheduled %s on %s for %s\n", message.ID, message.Channel, due.Format(time.RFC3339))
+	case *after > 0:
+		if _, err := publisher.PublishAfter(ctx, message, *after); err != nil {
+			return err
+		}
+		fmt.Printf("Scheduled %s on %s in %s\n", message.ID, message.Channel, *after)
+	default:
+		receivers, err := publisher.PublishMessages(ctx, message)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Published %s on %s to %d subscriber(s)\n", message.ID, message.Channel, receivers)
+	}
+	return nil
+}
+
+// readMessageData parses a JSON argument, "@file" or "@-" for stdin, so
+// the configured codec can encode it.
+func readMessageData(arg string) (interface{}, error) {
+	raw := []byte(arg)
+	if strings.HasPrefix(arg, "@") {
+		var err error
+		if arg == "@-" {
+			raw, err = io.ReadAll(os.Stdin)
+		} else {
+			raw, err = os.ReadFile(arg[1:])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var data interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("message is not valid JSON: %w", err)
+	}
+	return data, nil
+}
+
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+func runSub(ctx context.Context, config Config, redisClient Redis, args []string) error {
+	flags := newFlagSet("sub", "[flags] <channel|pattern>...")
+	asJSON := flags.Bool("json", false, "print one JSON object per message")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("expected at least one channel or pattern")
+	}
+
+	output := printDelivery
+	if *asJSON {
+		output = printDeliveryJSON
+	}
+	open, err := displayOpener(config)
+	if err != nil {
+		return err
+	}
+	return tail(ctx, config, redisClient, flags.Args(), func(ctx context.Context, delivery Delivery) error {
+		delivery, err := open(delivery)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "msgctl: skipping message %s: %v\n", delivery.Envelope.ID, err)
+			return nil
+		}
+		output(os.Stdout, delivery)
+		return nil
+	})
+}
+
+// displayOpener verifies and decrypts deliveries with the configured keys
+// before they are printed, as the service's consumers would. Recording
+// skips it, since recordings keep the wire payload.
+func displayOpener(config Config) (func(Delivery) (Delivery, error), error) {
+	signingKeys, encryptionKeys, err := loadKeyrings(config)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := make(map[string]bool, len(config.EncryptedChannels))
+	for _, channel := range config.EncryptedChannels {
+		encrypted[channel] = true
+	}
+	return func(delivery Delivery) (Delivery, error) {
+		var keys *Keyring
+		if encrypted[delivery.Channel] || delivery.Envelope.EncryptionKeyID != "" {
+			keys = encryptionKeys
+		}
+		return openDelivery(delivery, signingKeys, keys)
+	}, nil
+}
+
+// tail calls handler for every message on names until ctx is done.
+func tail(ctx context.Context, config Config, redisClient Redis, names []string, handler Handler) error {
+	if config.Transport == TransportStreams {
+		return tailStreams(ctx, redisClient, names, handler)
+	}
+
+	// Tailing must not take part in deduplication, worker limits or dead
+	// lettering, so the consumer only shares the connection settings.
+	consumer := NewMessageConsumer(redisClient)
+	consumer.SetReconnectOptions(config.Reconnect)
+	var channels []string
+	for _, name := range names {
+		if isPattern(name) {
+			consumer.HandlePattern(name, handler)
+			continue
+		}
+		consumer.Handle(name, handler)
+		channels = append(channels, name)
+	}
+	if err := consumer.Start(ctx, channels); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	stopCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	return consumer.Stop(stopCtx)
+}
+
+// tailStreams reads new stream entries with plain XREAD, so it never joins
+// or disturbs the consumer group of the real consumers.
+func tailStreams(ctx context.Context, redisClient Redis, channels []string, handler Handler) error {
+	streams := make([]string, 0, 2*len(channels))
+	for _, channel := range channels {
+		if isPattern(channel) {
+			return ErrPatternsUnsupported
+		}
+		streams = append(streams, streamKey(channel))
+	}
+	for range channels {
+		streams = append(streams, "$")
+	}
+
+	for {
+		results, err := redisClient.RedisClient.XRead(ctx, &redis.XReadArgs{Streams: streams, Block: time.Second}).Result()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			channel := strings.TrimPrefix(result.Stream, streamKey(""))
+			for _, message := range result.Messages {
+				payload, _ := message.Values[streamDataField].(string)
+				if err := handler(ctx, newDelivery(channel, []byte(payload))); err != nil {
+					return err
+				}
+				for i := range channels {
+					if streams[i] == result.Stream {
+						streams[len(channels)+i] = message.ID
+					}
+				}
+			}
+		}
+	}
+}
+
+func decodeForDisplay(delivery Delivery) interface{} {
+	var data interface{}
+	if err := delivery.Envelope.Decode(&data); err != nil {
+		return string(delivery.Payload)
+	}
+	return data
+}
+
+func printDelivery(w io.Writer, delivery Delivery) {
+	envelope := delivery.Envelope
+	fmt.Fprintf(w, "[%s] %s", delivery.Channel, envelope.ProducedAt.Local().Format(time.RFC3339))
+	if delivery.Pattern != "" {
+		fmt.Fprintf(w, " pattern=%s", delivery.Pattern)
+	}
+	if envelope.ID != "" {
+		fmt.Fprintf(w, " id=%s", envelope.ID)
+	}
+	if envelope.Producer != "" {
+		fmt.Fprintf(w, " producer=%s", envelope.Producer)
+	}
+	fmt.Fprintln(w)
+	keys := make([]string, 0, len(envelope.Headers))
+	for key := range envelope.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s: %s\n", key, envelope.Headers[key])
+	}
+	data, err := json.MarshalIndent(decodeForDisplay(delivery), "  ", "  ")
+	if err != nil {
+		data = delivery.Payload
+	}
+	fmt.Fprintf(w, "  %s\n\n", data)
+}
+
+func printDeliveryJSON(w io.Writer, delivery Delivery) {
+	envelope := delivery.Envelope
+	json.NewEncoder(w).Encode(struct {
+		Channel    string            `json:"channel"`
+		Pattern    string            `json:"pattern,omitempty"`
+		ID         string            `json:"id,omitempty"`
+		Producer   string            `json:"producer,omitempty"`
+		ProducedAt time.Time         `json:"produced_at"`
+		Headers    map[string]string `json:"headers,omitempty"`
+		Data       interface{}       `json:"data"`
+	}{
+		Channel:    delivery.Channel,
+		Pattern:    delivery.Pattern,
+		ID:         envelope.ID,
+		Producer:   envelope.Producer,
+		ProducedAt: envelope.ProducedAt,
+		Headers:    envelope.Headers,
+		Data:       decodeForDisplay(delivery),
+	})
+}
+
+func runStats(ctx context.Context, config Config, redisClient Redis, args []string) error {
+	flags := newFlagSet("stats", "[channel...]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client := redisClient.RedisClient
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	channels := flags.Args()
+	if len(channels) == 0 {
+		active, err := client.PubSubChannels(ctx, "*").Result()
+		if err != nil {
+			return err
+		}
+		channels = active
+	}
+	subscribers, err := client.PubSubNumSub(ctx, channels...).Result()
+	if err != nil {
+		return err
+	}
+	patterns, err := client.PubSubNumPat(ctx).Result()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "CHANNEL\tSUBSCRIBERS")
+	for _, channel := range channels {
+		fmt.Fprintf(w, "%s\t%d\n", channel, subscribers[channel])
+	}
+	fmt.Fprintf(w, "(patterns)\t%d\n\n", patterns)
+
+	if config.Transport == TransportStreams && len(flags.Args()) > 0 {
+		fmt.Fprintln(w, "STREAM\tLENGTH\tPENDING")
+		for _, channel := range flags.Args() {
+			length, err := client.XLen(ctx, streamKey(channel)).Result()
+			if err != nil {
+				return err
+			}
+			var pending int64
+			if summary, err := client.XPending(ctx, streamKey(channel), config.Streams.Group).Result(); err == nil {
+				pending = summary.Count
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\n", channel, length, pending)
+		}
+		fmt.Fprintln(w)
+	}
+
+	scheduled, err := client.ZCard(ctx, config.Schedule.Key).Result()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Scheduled messages\t%d\n", scheduled)
+	if config.DeadLetterKey != "" && config.DeadLetterTarget == DeadLetterList {
+		letters, err := NewDeadLetterQueue(redisClient, config.DeadLetterKey, config.DeadLetterTarget).Len(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Dead letters (%s)\t%d\n", config.DeadLetterKey, letters)
+	}
+	return nil
+}
+
+func runRecord(ctx context.Context, config Config, redisClient Redis, args []string) error {
+	flags := newFlagSet("record", "[flags] <channel|pattern>...")
+	path := flags.String("o", "-", "file to write, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("expected at least one channel or pattern")
+	}
+
+	out := os.Stdout
+	if *path != "-" {
+		file, err := os.OpenFile(*path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	recorder := NewRecorder(out)
+	err := tail(ctx, config, redisClient, flags.Args(), recorder.Record)
+	fmt.Fprintf(os.Stderr, "Recorded %d message(s)\n", recorder.Count())
+	return err
+}
+
+func runReplay(ctx context.Context, config Config, redisClient Redis, args []string) error {
+	flags := newFlagSet("replay", "[flags] <file|->")
+	var options ReplayOptions
+	flags.Float64Var(&options.Speed, "speed", 1, "pace relative to the recording, 0 for as fast as possible")
+	channels := flags.String("channels", "", "comma-separated channels or patterns to replay")
+	from := flags.String("from", "", "skip messages received before this RFC 3339 time")
+	until := flags.String("until", "", "skip messages received at or after this RFC 3339 time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected a recording file")
+	}
+	options.Channels = splitList(*channels)
+	for _, bound := range []struct {
+		value  string
+		target *time.Time
+	}{{*from, &options.From}, {*until, &options.Until}} {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return err
+		}
+		*bound.target = parsed
+	}
+
+	in := os.Stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	publisher, err := newPublisher(config, redisClient)
+	if err != nil {
+		return err
+	}
+	published, err := publisher.Replay(ctx, in, options)
+	fmt.Fprintf(os.Stderr, "Replayed %d message(s)\n", published)
+	return err
+}
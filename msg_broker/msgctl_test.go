@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestRunCLIWithoutCommandPrintsUsage(t *testing.T) {
+	if code := runCLI(nil); code != 2 {
+		t.Fatalf("runCLI(nil) = %d, want 2", code)
+	}
+	if code := runCLI([]string{"bogus"}); code != 2 {
+		t.Fatalf("runCLI(bogus) = %d, want 2", code)
+	}
+}
+
+func TestDisplayOpenerVerifiesAndDecrypts(t *testing.T) {
+	config := validConfig(t)
+	config.Signing.Keys = map[string]string{"k1": base64.StdEncoding.EncodeToString([]byte("signing secret"))}
+	config.Encryption.Keys = map[string]string{"e1": base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))}
+	config.EncryptedChannels = []string{"payments"}
+	open, err := displayOpener(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := newPublisher(config, Redis{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := publisher.serialize(Message{Channel: "payments", Data: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery, err := open(newDelivery("payments", payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := decodeForDisplay(delivery); data != "secret" {
+		t.Fatalf("displayed %v, want the decrypted payload", data)
+	}
+
+	unsigned, err := NewMessagePublisher(NewMemoryBroker()).serialize(Message{Channel: "orders", Data: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(newDelivery("orders", unsigned)); !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("open() of an unsigned message = %v, want ErrUnsigned", err)
+	}
+}
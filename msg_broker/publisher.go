@@ -3,31 +3,157 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Message struct {
-	Channel string
-	Data    interface{}
+	Channel       string
+	Data          interface{}
+	ID            string
+	SchemaVersion int
+	Headers       map[string]string
 }
 
 type MessagePublisher struct {
-	redisClient Redis
+	broker      Broker
+	transport   Transport
+	streams     StreamOptions
+	producer    string
+	codec       Codec
+	codecs      map[string]Codec
+	policy      DeliveryPolicy
+	middleware  []PublishMiddleware
+	metrics     *Metrics
+	tracer      trace.Tracer
+	schedule    ScheduleOptions
+	schemas     map[string]*jsonschema.Schema
+	signingKeys *Keyring
+	encryption  map[string]*Keyring
+}
+
+func NewMessagePublisher(broker Broker) *MessagePublisher {
+	return &MessagePublisher{
+		broker:     broker,
+		transport:  TransportPubSub,
+		codec:      JSONCodec,
+		codecs:     make(map[string]Codec),
+		schemas:    make(map[string]*jsonschema.Schema),
+		encryption: make(map[string]*Keyring),
+		tracer:     defaultTracer(),
+		schedule:   defaultScheduleOptions,
+	}
+}
+
+func NewStreamPublisher(redisClient Redis, streams StreamOptions) *MessagePublisher {
+	return &MessagePublisher{
+		broker:     redisClient,
+		transport:  TransportStreams,
+		streams:    streams,
+		codec:      JSONCodec,
+		codecs:     make(map[string]Codec),
+		schemas:    make(map[string]*jsonschema.Schema),
+		encryption: make(map[string]*Keyring),
+		tracer:     defaultTracer(),
+		schedule:   defaultScheduleOptions,
+	}
+}
+
+func (p *MessagePublisher) SetProducer(name string) {
+	p.producer = name
 }
 
-func NewMessagePublisher(redisClient Redis) *MessagePublisher {
-	return &MessagePublisher{redisClient}
+// SetCodec sets the codec used for channels without a codec of their own.
+func (p *MessagePublisher) SetCodec(codec Codec) {
+	p.codec = codec
 }
 
-func (p *MessagePublisher) PublishMessages(ctx context.Context, message Message) {
-	serializedMessage, err := json.Marshal(message.Data)
+func (p *MessagePublisher) SetChannelCodec(channel string, codec Codec) {
+	p.codecs[channel] = codec
+}
+
+func (p *MessagePublisher) codecFor(channel string) Codec {
+	if codec, ok := p.codecs[channel]; ok {
+		return codec
+	}
+	return p.codec
+}
+
+func (p *MessagePublisher) newEnvelope(message Message, encryptionKeys *Keyring) (Envelope, error) {
+	codec := p.codecFor(message.Channel)
+	schema := p.schemas[message.Channel]
+	if schema != nil && !schemaSupports(codec.ContentType()) {
+		return Envelope{}, &ValidationError{Channel: message.Channel, Err: ErrSchemaCodec}
+	}
+	if err := validateValue(schema, message.Channel, message.Data); err != nil {
+		return Envelope{}, err
+	}
+	payload, err := codec.Marshal(message.Data)
 	if err != nil {
-		log.Printf("[%s] Failed to serialize message: %v", message.Channel, err)
-		return
+		return Envelope{}, err
+	}
+
+	id := message.ID
+	if id == "" {
+		id = newMessageID()
+	}
+	envelope := Envelope{
+		ID:            id,
+		ProducedAt:    time.Now().UTC(),
+		Producer:      p.producer,
+		SchemaVersion: message.SchemaVersion,
+		Headers:       message.Headers,
+	}
+	if err := envelope.setPayload(codec, payload); err != nil {
+		return Envelope{}, err
+	}
+	if err := p.seal(&envelope, message.Channel, encryptionKeys); err != nil {
+		return Envelope{}, err
+	}
+	return envelope, nil
+}
+
+func (p *MessagePublisher) serialize(message Message) ([]byte, error) {
+	envelope, err := p.newEnvelope(message, p.encryption[message.Channel])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// PublishMessages publishes a message and returns the number of subscribers
+// that received it, subject to the publisher's delivery policy. With the
+// streams transport the message is always stored and the count is zero.
+func (p *MessagePublisher) PublishMessages(ctx context.Context, message Message) (int64, error) {
+	return p.wrap(p.publish)(ctx, message)
+}
+
+func (p *MessagePublisher) publish(ctx context.Context, message Message) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	ctx, span, message := p.startPublishSpan(ctx, message)
+	var receivers int64
+	serializedMessage, err := p.serialize(message)
+	if err == nil {
+		receivers, err = p.publishPayload(ctx, message.Channel, serializedMessage)
+	}
+	p.metrics.observePublish(message.Channel, err)
+	endSpan(span, err)
+	return receivers, err
+}
+
+func (p *MessagePublisher) publishPayload(ctx context.Context, channel string, payload []byte) (int64, error) {
+	if p.transport == TransportStreams {
+		return 0, p.publishStream(ctx, channel, payload)
 	}
 
-	err = p.redisClient.RedisClient.Publish(message.Channel, serializedMessage).Err()
+	receivers, err := p.broker.Publish(ctx, channel, payload)
 	if err != nil {
-		log.Printf("[%s] Failed to publish message: %v", message.Channel, err)
+		return 0, err
 	}
+	return receivers, p.applyDeliveryPolicy(ctx, channel, payload, receivers)
 }
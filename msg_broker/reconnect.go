@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+)
+
+var ErrReconnectFailed = errors.New("gave up reconnecting to redis")
+
+type HealthState int
+
+const (
+	HealthConnected HealthState = iota
+	HealthReconnecting
+	HealthFailed
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthConnected:
+		return "connected"
+	case HealthReconnecting:
+		return "reconnecting"
+	case HealthFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+type ReconnectOptions struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is the number of reconnection attempts before the consumer
+	// reports HealthFailed; zero retries forever.
+	MaxAttempts int
+	// PingInterval is how long a subscription may stay silent before it is
+	// pinged; a second silent interval marks the connection as lost.
+	PingInterval time.Duration
+}
+
+func (o ReconnectOptions) backoff(attempt int) time.Duration {
+	backoff := o.MinBackoff
+	for i := 1; i < attempt && backoff < o.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.MaxBackoff {
+		backoff = o.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func (c *MessageConsumer) SetReconnectOptions(options ReconnectOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnect = options
+}
+
+// Health reports the worst state among the consumer's receive loops.
+func (c *MessageConsumer) Health() HealthState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.healthLocked()
+}
+
+func (c *MessageConsumer) OnHealthChange(fn func(HealthState)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.healthHandler = fn
+}
+
+func (c *MessageConsumer) healthLocked() HealthState {
+	health := HealthConnected
+	for _, state := range c.health {
+		if state > health {
+			health = state
+		}
+	}
+	return health
+}
+
+func (c *MessageConsumer) setHealth(loop string, state HealthState) {
+	c.mu.Lock()
+	before := c.healthLocked()
+	c.health[loop] = state
+	after := c.healthLocked()
+	handler := c.healthHandler
+	c.mu.Unlock()
+
+	if before != after && handler != nil {
+		handler(after)
+	}
+}
+
+func (c *MessageConsumer) clearHealth(loop string) {
+	c.mu.Lock()
+	before := c.healthLocked()
+	delete(c.health, loop)
+	after := c.healthLocked()
+	handler := c.healthHandler
+	c.mu.Unlock()
+
+	if before != after && handler != nil {
+		handler(after)
+	}
+}
+
+// reconnectWithBackoff calls connect until it succeeds, ctx is done or the
+// configured number of attempts is exhausted.
+func (c *MessageConsumer) reconnectWithBackoff(ctx context.Context, loop string, connect func() error) error {
+	c.mu.RLock()
+	options := c.reconnect
+	c.mu.RUnlock()
+
+	c.setHealth(loop, HealthReconnecting)
+	for attempt := 1; options.MaxAttempts <= 0 || attempt <= options.MaxAttempts; attempt++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(options.backoff(attempt)):
+		}
+
+		err := connect()
+		if err == nil {
+			log.Printf("[%s] Reconnected after %d attempt(s)\n", loop, attempt)
+			c.setHealth(loop, HealthConnected)
+			return nil
+		}
+		log.Printf("[%s] Reconnect attempt %d failed: %v", loop, attempt, err)
+	}
+
+	c.setHealth(loop, HealthFailed)
+	return ErrReconnectFailed
+}
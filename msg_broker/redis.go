@@ -1,19 +1,481 @@
 package main
 
-import "github.com/go-redis/redis"
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisMode string
+
+const (
+	RedisStandalone RedisMode = "standalone"
+	RedisSentinel   RedisMode = "sentinel"
+	RedisCluster    RedisMode = "cluster"
+)
+
+var ErrShardedPatterns = errors.New("pattern subscriptions are not supported with sharded pub/sub")
+
+// Redis is the Broker backed by a single node, a Sentinel-managed failover
+// group or a cluster, depending on how it was built by NewRedis.
 type Redis struct {
-	RedisClient *redis.Client
+	RedisClient redis.UniversalClient
+	// Sharded switches Publish and Subscribe to SPUBLISH and SSUBSCRIBE,
+	// so cluster pub/sub traffic stays on the shard owning the channel
+	// instead of being broadcast to every node.
+	Sharded bool
+}
+
+func NewRedis(config Config) (Redis, error) {
+	var tlsConfig *tls.Config
+	if config.TLS.Enabled {
+		var err error
+		if tlsConfig, err = newTLSConfig(config.TLS); err != nil {
+			return Redis{}, err
+		}
+	}
+
+	switch config.RedisMode {
+	case RedisSentinel:
+		return Redis{RedisClient: redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.SentinelMaster,
+			SentinelAddrs:    config.RedisAddrs,
+			SentinelPassword: config.SentinelPassword,
+			Username:         config.RedisUsername,
+			Password:         config.RedisPassword,
+			DB:               config.RedisDB,
+			PoolSize:         config.Pool.Size,
+			DialTimeout:      config.Pool.DialTimeout,
+			ReadTimeout:      config.Pool.ReadTimeout,
+			WriteTimeout:     config.Pool.WriteTimeout,
+			TLSConfig:        tlsConfig,
+		})}, nil
+	case RedisCluster:
+		return Redis{
+			RedisClient: redis.NewClusterClient(&redis.ClusterOptions{
+				Addrs:        config.RedisAddrs,
+				Username:     config.RedisUsername,
+				Password:     config.RedisPassword,
+				PoolSize:     config.Pool.Size,
+				DialTimeout:  config.Pool.DialTimeout,
+				ReadTimeout:  config.Pool.ReadTimeout,
+				WriteTimeout: config.Pool.WriteTimeout,
+				TLSConfig:    tlsConfig,
+			}),
+			Sharded: config.ShardedPubSub,
+		}, nil
+	default:
+		return Redis{RedisClient: redis.NewClient(&redis.Options{
+			Addr:         net.JoinHostPort(config.RedisHost, config.RedisPort),
+			Username:     config.RedisUsername,
+			Password:     config.RedisPassword,
+			DB:           config.RedisDB,
+			PoolSize:     config.Pool.Size,
+			DialTimeout:  config.Pool.DialTimeout,
+			ReadTimeout:  config.Pool.ReadTimeout,
+			WriteTimeout: config.Pool.WriteTimeout,
+			TLSConfig:    tlsConfig,
+		})}, nil
+	}
+}
+
+// newTLSConfig leaves ServerName empty unless configured, so that each
+// Sentinel or cluster node is verified against its own hostname.
+func newTLSConfig(options TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// publish queues PUBLISH or SPUBLISH on client, which may be a pipeline.
+func (r Redis) publish(ctx context.Context, client redis.Cmdable, channel string, payload []byte) *redis.IntCmd {
+	if r.Sharded {
+		return client.SPublish(ctx, channel, payload)
+	}
+	return client.Publish(ctx, channel, payload)
+}
+
+func (r Redis) Publish(ctx context.Context, channel string, payload []byte) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.publish(ctx, r.RedisClient, channel, payload).Result()
+}
+
+func (r Redis) Subscribe(ctx context.Context, channels ...string) (Subscription, error) {
+	if r.Sharded {
+		subscription := newShardedSubscription(r.RedisClient)
+		return subscription, r.open(subscription, subscription.Subscribe(ctx, channels...))
+	}
+	subscription := &redisSubscription{pubsub: r.RedisClient.Subscribe(ctx)}
+	return subscription, r.open(subscription, subscription.Subscribe(ctx, channels...))
+}
+
+func (r Redis) PSubscribe(ctx context.Context, patterns ...string) (Subscription, error) {
+	if r.Sharded {
+		return nil, ErrShardedPatterns
+	}
+	subscription := &redisSubscription{pubsub: r.RedisClient.Subscribe(ctx)}
+	return subscription, r.open(subscription, subscription.PSubscribe(ctx, patterns...))
+}
+
+func (r Redis) open(subscription Subscription, err error) error {
+	if err != nil {
+		subscription.Close()
+	}
+	return err
+}
+
+func (r Redis) Close() error {
+	return r.RedisClient.Close()
+}
+
+func (r Redis) Push(ctx context.Context, key string, payload []byte) error {
+	return r.RedisClient.RPush(ctx, key, payload).Err()
+}
+
+func (r Redis) Pop(ctx context.Context, key string) ([]byte, error) {
+	payload, err := r.RedisClient.LPop(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrListEmpty
+	}
+	return payload, err
+}
+
+func (r Redis) Range(ctx context.Context, key string, start, stop int64) ([][]byte, error) {
+	values, err := r.RedisClient.LRange(ctx, key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, len(values))
+	for i, value := range values {
+		payloads[i] = []byte(value)
+	}
+	return payloads, nil
+}
+
+func (r Redis) Len(ctx context.Context, key string) (int64, error) {
+	return r.RedisClient.LLen(ctx, key).Result()
+}
+
+func (r Redis) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return r.RedisClient.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (r Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.RedisClient.Set(ctx, key, value, ttl).Err()
+}
+
+func (r Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.RedisClient.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (r Redis) Delete(ctx context.Context, key string) error {
+	return r.RedisClient.Del(ctx, key).Err()
+}
+
+// popDueScript removes due entries in one step, so schedulers running on
+// several instances never pop the same entry.
+var popDueScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local payloads = {}
+for _, id in ipairs(ids) do
+	local payload = redis.call('HGET', KEYS[2], id)
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('HDEL', KEYS[2], id)
+	if payload then
+		table.insert(payloads, payload)
+	end
+end
+return payloads
+`)
+
+// scheduledPayloadsKey holds the payloads of the sorted set at key. It
+// shares key's hash tag, if any, so both live in the same cluster slot.
+func scheduledPayloadsKey(key string) string {
+	return key + ":payloads"
+}
+
+// hasHashTag reports whether key has a non-empty {...} section, the part
+// Redis Cluster hashes instead of the whole key.
+func hasHashTag(key string) bool {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return false
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	return end > 0
+}
+
+func (r Redis) Schedule(ctx context.Context, key, id string, due time.Time, payload []byte) error {
+	_, err := r.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, scheduledPayloadsKey(key), id, payload)
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(due.UnixMilli()), Member: id})
+		return nil
+	})
+	return err
+}
+
+func (r Redis) PopDue(ctx context.Context, key string, until time.Time, limit int64) ([][]byte, error) {
+	values, err := popDueScript.Run(ctx, r.RedisClient, []string{key, scheduledPayloadsKey(key)}, until.UnixMilli(), limit).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	payloads := make([][]byte, len(values))
+	for i, value := range values {
+		payloads[i] = []byte(value)
+	}
+	return payloads, nil
 }
 
-func NewRedis(config Config) Redis {
-	client := redis.NewClient(&redis.Options{
-		Addr:     config.RedisHost + ":" + config.RedisPort,
-		Password: config.RedisPassword,
-		DB:       0,
+func (r Redis) Unschedule(ctx context.Context, key, id string) (bool, error) {
+	var removed *redis.IntCmd
+	_, err := r.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.ZRem(ctx, key, id)
+		pipe.HDel(ctx, scheduledPayloadsKey(key), id)
+		return nil
 	})
+	if err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+type redisSubscription struct {
+	pubsub *redis.PubSub
+
+	mu        sync.Mutex
+	receiving bool
+	// pending holds messages read while waiting for a confirmation.
+	pending []BrokerMessage
+}
+
+func (s *redisSubscription) Receive(pingInterval time.Duration) (BrokerMessage, error) {
+	s.mu.Lock()
+	if len(s.pending) > 0 {
+		message := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+		return message, nil
+	}
+	s.receiving = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.receiving = false
+		s.mu.Unlock()
+	}()
+
+	pinged := false
+	for {
+		msg, err := s.pubsub.ReceiveTimeout(context.Background(), pingInterval)
+		if err != nil {
+			// A silent connection is pinged once; if the pong does not
+			// arrive within another interval the connection is dead.
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !pinged {
+				pinged = true
+				if err = s.pubsub.Ping(context.Background()); err == nil {
+					continue
+				}
+			}
+			return BrokerMessage{}, err
+		}
+
+		pinged = false
+		if message, ok := msg.(*redis.Message); ok {
+			return brokerMessage(message), nil
+		}
+	}
+}
+
+func (s *redisSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	return s.change(ctx, "subscribe", channels, s.pubsub.Subscribe)
+}
+
+func (s *redisSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	return s.change(ctx, "unsubscribe", channels, s.pubsub.Unsubscribe)
+}
+
+func (s *redisSubscription) PSubscribe(ctx context.Context, patterns ...string) error {
+	return s.change(ctx, "psubscribe", patterns, s.pubsub.PSubscribe)
+}
+
+func (s *redisSubscription) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return s.change(ctx, "punsubscribe", patterns, s.pubsub.PUnsubscribe)
+}
+
+// change sends a (un)subscribe command. While no Receive call is reading
+// the connection it also waits for Redis to confirm every name, so that
+// messages published afterwards are guaranteed to be received; otherwise
+// the confirmations are consumed by Receive.
+func (s *redisSubscription) change(ctx context.Context, kind string, names []string, send func(context.Context, ...string) error) error {
+	if len(names) == 0 {
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := send(ctx, names...); err != nil {
+		return err
+	}
+	if s.receiving {
+		return nil
+	}
+
+	unconfirmed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		unconfirmed[name] = struct{}{}
+	}
+	for len(unconfirmed) > 0 {
+		msg, err := s.pubsub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == kind {
+				delete(unconfirmed, msg.Channel)
+			}
+		case *redis.Message:
+			s.pending = append(s.pending, brokerMessage(msg))
+		}
+	}
+	return nil
+}
+
+func (s *redisSubscription) Close() error {
+	return s.pubsub.Close()
+}
+
+func brokerMessage(message *redis.Message) BrokerMessage {
+	return BrokerMessage{
+		Channel: message.Channel,
+		Pattern: message.Pattern,
+		Payload: []byte(message.Payload),
+	}
+}
+
+// shardedSubscription multiplexes SSUBSCRIBE channels, which on a cluster
+// must each be subscribed on the node owning the channel's slot, so every
+// channel gets its own connection. go-redis pings and reconnects these
+// connections itself, so Receive only fails once the subscription is
+// closed.
+type shardedSubscription struct {
+	client   redis.UniversalClient
+	mu       sync.Mutex
+	shards   map[string]*redis.PubSub
+	messages chan BrokerMessage
+	done     chan struct{}
+	closed   bool
+}
+
+func newShardedSubscription(client redis.UniversalClient) *shardedSubscription {
+	return &shardedSubscription{
+		client:   client,
+		shards:   make(map[string]*redis.PubSub),
+		messages: make(chan BrokerMessage),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *shardedSubscription) Receive(pingInterval time.Duration) (BrokerMessage, error) {
+	select {
+	case message := <-s.messages:
+		return message, nil
+	case <-s.done:
+		return BrokerMessage{}, ErrSubscriptionClosed
+	}
+}
+
+func (s *shardedSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSubscriptionClosed
+	}
+
+	for _, channel := range channels {
+		if _, ok := s.shards[channel]; ok {
+			continue
+		}
+		pubsub := s.client.SSubscribe(ctx, channel)
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return err
+		}
+		s.shards[channel] = pubsub
+		go s.forward(pubsub.Channel())
+	}
+	return nil
+}
 
-	return Redis{
-		RedisClient: client,
+func (s *shardedSubscription) forward(messages <-chan *redis.Message) {
+	for message := range messages {
+		select {
+		case s.messages <- brokerMessage(message):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *shardedSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		if pubsub, ok := s.shards[channel]; ok {
+			pubsub.Close()
+			delete(s.shards, channel)
+		}
+	}
+	return nil
+}
+
+func (s *shardedSubscription) PSubscribe(ctx context.Context, patterns ...string) error {
+	return ErrShardedPatterns
+}
+
+func (s *shardedSubscription) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return ErrShardedPatterns
+}
+
+func (s *shardedSubscription) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for channel, pubsub := range s.shards {
+		pubsub.Close()
+		delete(s.shards, channel)
 	}
+	return nil
 }
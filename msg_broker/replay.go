@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// RecordedMessage is one line of a JSON Lines traffic recording. Envelopes
+// are stored inline as JSON, any other payload in Raw.
+type RecordedMessage struct {
+	ReceivedAt time.Time       `json:"received_at"`
+	Channel    string          `json:"channel"`
+	Pattern    string          `json:"pattern,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Raw        []byte          `json:"raw,omitempty"`
+}
+
+func (m RecordedMessage) payload() []byte {
+	if m.Payload != nil {
+		return m.Payload
+	}
+	return m.Raw
+}
+
+// Recorder writes every delivery it sees to w as JSON Lines. It is safe for
+// concurrent use by several workers and consumers.
+type Recorder struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	count   int
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{encoder: json.NewEncoder(w)}
+}
+
+// Record is a Handler that only records, for consumers that capture
+// traffic without processing it.
+func (r *Recorder) Record(ctx context.Context, delivery Delivery) error {
+	message := RecordedMessage{
+		ReceivedAt: time.Now().UTC(),
+		Channel:    delivery.Channel,
+		Pattern:    delivery.Pattern,
+	}
+	if json.Valid(delivery.Payload) {
+		message.Payload = delivery.Payload
+	} else {
+		message.Raw = delivery.Payload
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.encoder.Encode(message); err != nil {
+		return err
+	}
+	r.count++
+	return nil
+}
+
+// Middleware records deliveries before handing them to the consumer's own
+// handlers. Recording failures are not the handler's, so they are dropped.
+func (r *Recorder) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, delivery Delivery) error {
+			_ = r.Record(ctx, delivery)
+			return next(ctx, delivery)
+		}
+	}
+}
+
+func (r *Recorder) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// ReplayOptions select which recorded messages are published and how fast.
+type ReplayOptions struct {
+	// Speed scales the recorded pace: 1 keeps the original gaps between
+	// messages, 10 replays ten times faster and 0 as fast as possible.
+	Speed float64
+	// Channels limits the replay to channels matching any of these
+	// glob-style patterns; empty replays every channel.
+	Channels []string
+	// From and Until bound ReceivedAt when non-zero; Until is exclusive.
+	From  time.Time
+	Until time.Time
+}
+
+func (o ReplayOptions) selects(message RecordedMessage) bool {
+	if !o.From.IsZero() && message.ReceivedAt.Before(o.From) {
+		return false
+	}
+	if !o.Until.IsZero() && !message.ReceivedAt.Before(o.Until) {
+		return false
+	}
+	if len(o.Channels) == 0 {
+		return true
+	}
+	for _, pattern := range o.Channels {
+		if globMatch(pattern, message.Channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replay publishes the recorded payloads read from r unchanged, so
+// envelopes keep their original IDs and headers, and returns how many were
+// published. It stops at the first publish error.
+func (p *MessagePublisher) Replay(ctx context.Context, r io.Reader, options ReplayOptions) (int, error) {
+	if options.Speed < 0 {
+		return 0, errors.New("replay speed must not be negative")
+	}
+
+	decoder := json.NewDecoder(r)
+	var first, start time.Time
+	published := 0
+	for {
+		var message RecordedMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return published, nil
+			}
+			return published, err
+		}
+		if !options.selects(message) {
+			continue
+		}
+
+		if options.Speed > 0 {
+			if first.IsZero() {
+				first, start = message.ReceivedAt, time.Now()
+			}
+			offset := time.Duration(float64(message.ReceivedAt.Sub(first)) / options.Speed)
+			if err := sleepUntil(ctx, start.Add(offset)); err != nil {
+				return published, err
+			}
+		} else if err := ctx.Err(); err != nil {
+			return published, err
+		}
+
+		_, err := p.publishPayload(ctx, message.Channel, message.payload())
+		p.metrics.observePublish(message.Channel, err)
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+}
+
+func sleepUntil(ctx context.Context, deadline time.Time) error {
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
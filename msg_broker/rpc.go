@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	HeaderReplyTo       = "reply-to"
+	HeaderCorrelationID = "correlation-id"
+	HeaderError         = "error"
+)
+
+var ErrNoResponders = errors.New("no responders subscribed to channel")
+
+// defaultRequestTimeout applies to requests whose context has no deadline,
+// so a missing responder cannot block the caller forever.
+const defaultRequestTimeout = 30 * time.Second
+
+// RemoteError is returned by Request when the responder's handler failed.
+type RemoteError struct {
+	Channel string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("[%s] responder failed: %s", e.Channel, e.Message)
+}
+
+type ResponderFunc func(ctx context.Context, request Delivery) (interface{}, error)
+
+// TypedResponder adapts a function taking a concrete request type into a
+// ResponderFunc, decoding the request before calling it.
+func TypedResponder[T any](fn func(context.Context, T) (interface{}, error)) ResponderFunc {
+	return func(ctx context.Context, request Delivery) (interface{}, error) {
+		var value T
+		if err := request.Envelope.Decode(&value); err != nil {
+			return nil, &DecodeError{Channel: request.Channel, Err: err}
+		}
+		return fn(ctx, value)
+	}
+}
+
+func replyChannel(correlationID string) string {
+	return "_reply." + correlationID
+}
+
+// serializeReply encrypts a reply with the keyring of the request's
+// channel, since reply channels are unique to a request and have none of
+// their own. The reply channel is still what the ciphertext and signature
+// are bound to.
+func (p *MessagePublisher) serializeReply(requestChannel string, reply Message) ([]byte, error) {
+	envelope, err := p.newEnvelope(reply, p.encryption[requestChannel])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// Request publishes payload to channel and waits for the responder's reply
+// on a reply channel unique to this request. The reply is returned as a
+// Delivery so it can be decoded with Envelope.Decode. With signing keys or
+// encryption configured for channel, replies that fail verification or
+// decryption are ignored.
+func (p *MessagePublisher) Request(ctx context.Context, channel string, payload interface{}) (Delivery, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+
+	correlationID := newMessageID()
+	replyTo := replyChannel(correlationID)
+
+	// Subscribe before publishing so a fast reply cannot be missed.
+	subscription, err := p.broker.Subscribe(ctx, replyTo)
+	if err != nil {
+		return Delivery{}, err
+	}
+	defer subscription.Close()
+
+	receivers, err := p.PublishMessages(ctx, Message{
+		Channel: channel,
+		Data:    payload,
+		ID:      correlationID,
+		Headers: map[string]string{
+			HeaderReplyTo:       replyTo,
+			HeaderCorrelationID: correlationID,
+		},
+	})
+	if err != nil {
+		return Delivery{}, err
+	}
+	if receivers == 0 && p.transport == TransportPubSub {
+		return Delivery{}, ErrNoResponders
+	}
+
+	replies := make(chan Delivery, 1)
+	failures := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := subscription.Receive(defaultReconnectOptions.PingInterval)
+			if err != nil {
+				failures <- err
+				return
+			}
+			reply, err := openDelivery(newDelivery(msg.Channel, msg.Payload), p.signingKeys, p.encryption[channel])
+			if err != nil {
+				log.Printf("[%s] Ignoring reply: %v", channel, err)
+				continue
+			}
+			if reply.Envelope.Headers[HeaderCorrelationID] == correlationID {
+				replies <- reply
+				return
+			}
+		}
+	}()
+
+	select {
+	case reply := <-replies:
+		if message, ok := reply.Envelope.Headers[HeaderError]; ok {
+			return reply, &RemoteError{Channel: channel, Message: message}
+		}
+		return reply, nil
+	case err := <-failures:
+		return Delivery{}, err
+	case <-ctx.Done():
+		return Delivery{}, ctx.Err()
+	}
+}
+
+// Respond registers a handler on channel that answers requests made with
+// Request. Replies are published through publisher's broker and codec, and
+// signed and encrypted with its keys for channel. Messages without a
+// reply-to header are handled without replying.
+func (c *MessageConsumer) Respond(channel string, publisher *MessagePublisher, responder ResponderFunc) {
+	c.Handle(channel, func(ctx context.Context, request Delivery) error {
+		result, err := responder(ctx, request)
+
+		replyTo := request.Envelope.Headers[HeaderReplyTo]
+		if replyTo == "" {
+			return err
+		}
+
+		headers := map[string]string{
+			HeaderCorrelationID: request.Envelope.Headers[HeaderCorrelationID],
+		}
+		if err != nil {
+			headers[HeaderError] = err.Error()
+			result = nil
+		}
+
+		// Replies always go over plain pub/sub, whatever the publisher's
+		// transport, since the requester is subscribed to replyTo.
+		serializedReply, serializeErr := publisher.serializeReply(channel, Message{
+			Channel: replyTo,
+			Data:    result,
+			Headers: headers,
+		})
+		if serializeErr != nil {
+			return serializeErr
+		}
+		_, publishErr := publisher.broker.Publish(ctx, replyTo, serializedReply)
+		return publishErr
+	})
+}
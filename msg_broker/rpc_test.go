@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestRepliesAreSignedAndEncrypted(t *testing.T) {
+	signingKeys := NewKeyring()
+	signingKeys.Add("k1", []byte("signing secret"))
+	encryptionKeys := NewKeyring()
+	encryptionKeys.Add("e1", []byte("0123456789abcdef0123456789abcdef"))
+
+	broker := NewMemoryBroker()
+	newPublisher := func() *MessagePublisher {
+		publisher := NewMessagePublisher(broker)
+		publisher.SetSigningKeys(signingKeys)
+		publisher.SetChannelEncryption("quotes", encryptionKeys)
+		return publisher
+	}
+	consumer := NewMessageConsumer(broker)
+	consumer.SetSigningKeys(signingKeys)
+	consumer.SetChannelEncryption("quotes", encryptionKeys)
+	consumer.Respond("quotes", newPublisher(), TypedResponder(func(ctx context.Context, symbol string) (interface{}, error) {
+		return symbol + ": 42", nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := consumer.Start(ctx, []string{"quotes"}); err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop(context.Background())
+
+	wire, err := broker.PSubscribe(ctx, "_reply.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wire.Close()
+
+	reply, err := newPublisher().Request(ctx, "quotes", "ACME")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var quote string
+	if err := reply.Envelope.Decode(&quote); err != nil || quote != "ACME: 42" {
+		t.Fatalf("reply = %q, %v; want %q", quote, err, "ACME: 42")
+	}
+
+	sent, err := wire.Receive(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := decodeEnvelope(sent.Payload)
+	if envelope.EncryptionKeyID != "e1" || envelope.Signature == "" {
+		t.Fatalf("reply went out with key %q and signature %q, want it encrypted and signed", envelope.EncryptionKeyID, envelope.Signature)
+	}
+}
+
+func TestRequestIgnoresUnverifiedReplies(t *testing.T) {
+	keys := NewKeyring()
+	keys.Add("k1", []byte("signing secret"))
+	broker := NewMemoryBroker()
+
+	consumer := NewMessageConsumer(broker)
+	// The responder does not sign, so its replies cannot be trusted.
+	consumer.Respond("quotes", NewMessagePublisher(broker), func(context.Context, Delivery) (interface{}, error) {
+		return "forged", nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := consumer.Start(ctx, []string{"quotes"}); err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop(context.Background())
+
+	requester := NewMessagePublisher(broker)
+	requester.SetSigningKeys(keys)
+	if _, err := requester.Request(ctx, "quotes", "ACME"); err != context.DeadlineExceeded {
+		t.Fatalf("Request() = %v, want the unsigned reply ignored until the deadline", err)
+	}
+}
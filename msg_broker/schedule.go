@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrSchedulingUnsupported = errors.New("broker does not support scheduled messages")
+
+// ScheduleBroker is implemented by brokers that can hold messages until a
+// due time, which delayed publishing relies on.
+type ScheduleBroker interface {
+	// Schedule stores payload under id, replacing any entry with that id.
+	Schedule(ctx context.Context, key, id string, due time.Time, payload []byte) error
+	// PopDue atomically removes and returns up to limit payloads due at or
+	// before until, oldest first, so concurrent schedulers never publish
+	// the same entry twice.
+	PopDue(ctx context.Context, key string, until time.Time, limit int64) ([][]byte, error)
+	// Unschedule removes the entry with id, reporting whether it existed.
+	Unschedule(ctx context.Context, key, id string) (bool, error)
+}
+
+func scheduleBroker(broker Broker) (ScheduleBroker, error) {
+	schedules, ok := broker.(ScheduleBroker)
+	if !ok {
+		return nil, ErrSchedulingUnsupported
+	}
+	return schedules, nil
+}
+
+// ScheduleOptions configure where scheduled messages are kept and how
+// often the scheduler looks for due ones. Publishers and schedulers must
+// agree on Key.
+type ScheduleOptions struct {
+	Key          string
+	PollInterval time.Duration
+	BatchSize    int64
+	// MaxAttempts bounds how often a message whose publish failed is
+	// tried, with the delay doubling from PollInterval in between.
+	MaxAttempts int
+}
+
+// The hash tag keeps the sorted set and its payloads in one cluster slot.
+var defaultScheduleOptions = ScheduleOptions{
+	Key:          "{scheduled}",
+	PollInterval: time.Second,
+	BatchSize:    100,
+	MaxAttempts:  5,
+}
+
+// SetScheduleOptions replaces the schedule options; zero fields keep their
+// defaults.
+func (p *MessagePublisher) SetScheduleOptions(options ScheduleOptions) {
+	if options.Key == "" {
+		options.Key = defaultScheduleOptions.Key
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultScheduleOptions.PollInterval
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaultScheduleOptions.BatchSize
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaultScheduleOptions.MaxAttempts
+	}
+	p.schedule = options
+}
+
+type scheduledMessage struct {
+	ID       string `json:"id"`
+	Channel  string `json:"channel"`
+	Payload  []byte `json:"payload"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// maxScheduleBackoff caps the retry delay at 64 poll intervals.
+const maxScheduleBackoff = 6
+
+func (o ScheduleOptions) retryDelay(attempts int) time.Duration {
+	shift := attempts - 1
+	if shift > maxScheduleBackoff {
+		shift = maxScheduleBackoff
+	}
+	return o.PollInterval << shift
+}
+
+// isFinalPublishError reports publish failures that come from the delivery
+// policy rather than the broker, which publishing again will not fix.
+func isFinalPublishError(err error) bool {
+	return errors.Is(err, ErrNoSubscribers) || errors.Is(err, ErrListsUnsupported)
+}
+
+// PublishAt serializes message now and parks it until at, when a scheduler
+// publishes it on its channel. It returns the message ID, which
+// CancelScheduled accepts; scheduling an ID again moves the message.
+func (p *MessagePublisher) PublishAt(ctx context.Context, message Message, at time.Time) (string, error) {
+	schedules, err := scheduleBroker(p.broker)
+	if err != nil {
+		return "", err
+	}
+	if message.ID == "" {
+		message.ID = newMessageID()
+	}
+
+	ctx, span, message := p.startPublishSpan(ctx, message)
+	serializedMessage, err := p.serialize(message)
+	if err == nil {
+		var entry []byte
+		entry, err = json.Marshal(scheduledMessage{ID: message.ID, Channel: message.Channel, Payload: serializedMessage})
+		if err == nil {
+			err = schedules.Schedule(ctx, p.schedule.Key, message.ID, at, entry)
+		}
+	}
+	endSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+	return message.ID, nil
+}
+
+func (p *MessagePublisher) PublishAfter(ctx context.Context, message Message, delay time.Duration) (string, error) {
+	return p.PublishAt(ctx, message, time.Now().Add(delay))
+}
+
+// CancelScheduled removes a message that has not been published yet,
+// reporting false if it was unknown or already published.
+func (p *MessagePublisher) CancelScheduled(ctx context.Context, id string) (bool, error) {
+	schedules, err := scheduleBroker(p.broker)
+	if err != nil {
+		return false, err
+	}
+	return schedules.Unschedule(ctx, p.schedule.Key, id)
+}
+
+// RunScheduler publishes due messages until ctx is done. Any number of
+// instances may run it against the same key; each message is published by
+// one of them.
+func (p *MessagePublisher) RunScheduler(ctx context.Context) error {
+	schedules, err := scheduleBroker(p.broker)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(p.schedule.PollInterval)
+	defer ticker.Stop()
+	for {
+		p.publishDue(ctx, schedules)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *MessagePublisher) publishDue(ctx context.Context, schedules ScheduleBroker) {
+	for {
+		entries, err := schedules.PopDue(ctx, p.schedule.Key, time.Now(), p.schedule.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[scheduler] Failed to read due messages: %v", err)
+			}
+			return
+		}
+
+		for _, entry := range entries {
+			var message scheduledMessage
+			if err := json.Unmarshal(entry, &message); err != nil {
+				log.Printf("[scheduler] Discarding unreadable scheduled message: %v", err)
+				continue
+			}
+			_, err := p.publishPayload(ctx, message.Channel, message.Payload)
+			p.metrics.observePublish(message.Channel, err)
+			if err == nil {
+				continue
+			}
+			message.Attempts++
+			if isFinalPublishError(err) || message.Attempts >= p.schedule.MaxAttempts {
+				log.Printf("[%s] Dropping scheduled message %s after %d attempts: %v", message.Channel, message.ID, message.Attempts, err)
+				continue
+			}
+			// The entry is already removed, so put it back rather than lose it.
+			log.Printf("[%s] Failed to publish scheduled message %s, retrying: %v", message.Channel, message.ID, err)
+			p.reschedule(ctx, schedules, message)
+		}
+		if int64(len(entries)) < p.schedule.BatchSize {
+			return
+		}
+	}
+}
+
+func (p *MessagePublisher) reschedule(ctx context.Context, schedules ScheduleBroker, message scheduledMessage) {
+	entry, err := json.Marshal(message)
+	if err == nil {
+		retryAt := time.Now().Add(p.schedule.retryDelay(message.Attempts))
+		err = schedules.Schedule(context.WithoutCancel(ctx), p.schedule.Key, message.ID, retryAt, entry)
+	}
+	if err != nil {
+		log.Printf("[%s] Lost scheduled message %s: %v", message.Channel, message.ID, err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type failingBroker struct {
+	*MemoryBroker
+	publishes atomic.Int32
+}
+
+func (b *failingBroker) Publish(ctx context.Context, channel string, payload []byte) (int64, error) {
+	b.publishes.Add(1)
+	return 0, errors.New("connection refused")
+}
+
+func TestSchedulerDropsMessagesRejectedByDeliveryPolicy(t *testing.T) {
+	broker := NewMemoryBroker()
+	publisher := NewMessagePublisher(broker)
+	publisher.SetDeliveryPolicy(DeliverRequireSubscribers)
+	ctx := context.Background()
+
+	id, err := publisher.PublishAt(ctx, Message{Channel: "reminders", Data: 1}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.publishDue(ctx, broker)
+
+	if scheduled, _ := publisher.CancelScheduled(ctx, id); scheduled {
+		t.Fatal("message without subscribers was scheduled again")
+	}
+}
+
+func TestSchedulerGivesUpAfterMaxAttempts(t *testing.T) {
+	broker := &failingBroker{MemoryBroker: NewMemoryBroker()}
+	publisher := NewMessagePublisher(broker)
+	publisher.SetScheduleOptions(ScheduleOptions{PollInterval: time.Millisecond, MaxAttempts: 3})
+	ctx := context.Background()
+
+	id, err := publisher.PublishAt(ctx, Message{Channel: "reminders", Data: 1}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		publisher.publishDue(ctx, broker)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := broker.publishes.Load(); got != 3 {
+		t.Fatalf("published %d times, want 3", got)
+	}
+	if scheduled, _ := publisher.CancelScheduled(ctx, id); scheduled {
+		t.Fatal("message is still scheduled after the last attempt")
+	}
+}
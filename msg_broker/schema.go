@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrSchemaCodec reports a schema on a channel whose codec cannot be
+// validated: protobuf and gob payloads only decode into the Go type they
+// were encoded from, so the consumer has no JSON form to check.
+var ErrSchemaCodec = errors.New("JSON Schema validation is not supported for protobuf and gob payloads")
+
+func schemaSupports(contentType string) bool {
+	return contentType != ContentTypeProtobuf && contentType != ContentTypeGob
+}
+
+// ValidationError reports a message that does not match its channel's
+// JSON Schema. Consumers treat it as permanent: retrying cannot fix it.
+type ValidationError struct {
+	Channel string
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("[%s] message does not match schema: %v", e.Channel, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// LoadSchema compiles the JSON Schema at path, which may also be a URL.
+func LoadSchema(path string) (*jsonschema.Schema, error) {
+	return jsonschema.Compile(path)
+}
+
+// CompileSchema compiles an in-memory JSON Schema; name identifies it in
+// error messages.
+func CompileSchema(name string, source []byte) (*jsonschema.Schema, error) {
+	return jsonschema.CompileString(name, string(source))
+}
+
+func loadSchemas(paths map[string]string) (map[string]*jsonschema.Schema, error) {
+	schemas := make(map[string]*jsonschema.Schema, len(paths))
+	for channel, path := range paths {
+		schema, err := LoadSchema(path)
+		if err != nil {
+			return nil, fmt.Errorf("MSG_BROKER_SCHEMAS: channel %s: %w", channel, err)
+		}
+		schemas[channel] = schema
+	}
+	return schemas, nil
+}
+
+// SetChannelSchema makes the publisher reject messages on channel whose
+// data does not match schema, before anything is sent. The channel must use
+// a codec other than protobuf or gob, or every message fails with
+// ErrSchemaCodec.
+func (p *MessagePublisher) SetChannelSchema(channel string, schema *jsonschema.Schema) {
+	p.schemas[channel] = schema
+}
+
+// SetChannelSchema makes the consumer check messages on channel, or on a
+// pattern registered with HandlePattern, before calling the handler.
+// Messages that do not match go to the error handler and dead-letter queue.
+func (c *MessageConsumer) SetChannelSchema(channel string, schema *jsonschema.Schema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas[channel] = schema
+}
+
+// validateValue checks a Go value by its JSON form, whatever codec
+// carries it on the wire.
+func validateValue(schema *jsonschema.Schema, channel string, value interface{}) error {
+	if schema == nil {
+		return nil
+	}
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return &ValidationError{Channel: channel, Err: err}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(serialized))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return &ValidationError{Channel: channel, Err: err}
+	}
+	if err := schema.Validate(document); err != nil {
+		return &ValidationError{Channel: channel, Err: err}
+	}
+	return nil
+}
+
+// validateDelivery decodes the envelope data generically and checks it.
+func validateDelivery(schema *jsonschema.Schema, delivery Delivery) error {
+	if schema == nil {
+		return nil
+	}
+	if !schemaSupports(delivery.Envelope.ContentType) {
+		return &ValidationError{Channel: delivery.Channel, Err: ErrSchemaCodec}
+	}
+	var value interface{}
+	if err := delivery.Envelope.Decode(&value); err != nil {
+		return &DecodeError{Channel: delivery.Channel, Err: err}
+	}
+	return validateValue(schema, delivery.Channel, value)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "total"],
+	"properties": {"id": {"type": "integer"}, "total": {"type": "number", "minimum": 0}}
+}`
+
+type order struct {
+	ID    int     `json:"id" msgpack:"id"`
+	Total float64 `json:"total" msgpack:"total"`
+}
+
+func TestSchemaValidatesBothSides(t *testing.T) {
+	schema, err := CompileSchema("order.json", []byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []Codec{JSONCodec, MsgPackCodec} {
+		publisher := NewMessagePublisher(NewMemoryBroker())
+		publisher.SetChannelCodec("orders", codec)
+
+		payload, err := publisher.serialize(Message{Channel: "orders", Data: order{ID: 1, Total: -5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		publisher.SetChannelSchema("orders", schema)
+		var invalid *ValidationError
+		if _, err := publisher.serialize(Message{Channel: "orders", Data: order{ID: 1, Total: -5}}); !errors.As(err, &invalid) {
+			t.Errorf("%s: publishing an invalid order = %v, want a ValidationError", codec.Name(), err)
+		}
+		// Consumers check messages from publishers without the schema.
+		if err := validateDelivery(schema, newDelivery("orders", payload)); !errors.As(err, &invalid) {
+			t.Errorf("%s: consuming an invalid order = %v, want a ValidationError", codec.Name(), err)
+		}
+
+		payload, err = publisher.serialize(Message{Channel: "orders", Data: order{ID: 2, Total: 9.5}})
+		if err != nil {
+			t.Fatalf("%s: publishing a valid order = %v", codec.Name(), err)
+		}
+		if err := validateDelivery(schema, newDelivery("orders", payload)); err != nil {
+			t.Errorf("%s: consuming a valid order = %v", codec.Name(), err)
+		}
+	}
+}
+
+func TestSchemaRejectsCodecsWithoutJSONForm(t *testing.T) {
+	schema, err := CompileSchema("order.json", []byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := NewMessagePublisher(NewMemoryBroker())
+	publisher.SetChannelCodec("orders", GobCodec)
+	payload, err := publisher.serialize(Message{Channel: "orders", Data: order{ID: 1, Total: 9.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publisher.SetChannelSchema("orders", schema)
+	if _, err := publisher.PublishMessages(context.Background(), Message{Channel: "orders", Data: order{ID: 1, Total: 9.5}}); !errors.Is(err, ErrSchemaCodec) {
+		t.Errorf("PublishMessages() = %v, want ErrSchemaCodec", err)
+	}
+	if err := validateDelivery(schema, newDelivery("orders", payload)); !errors.Is(err, ErrSchemaCodec) {
+		t.Errorf("validateDelivery() = %v, want ErrSchemaCodec", err)
+	}
+}
+
+func TestValidateRejectsSchemasWithProtobuf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "order.json")
+	if err := os.WriteFile(path, []byte(orderSchema), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := validConfig(t)
+	config.Schemas = map[string]string{"orders": path}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate() with the json codec = %v", err)
+	}
+	config.Codec = "protobuf"
+	if err := config.Validate(); !errors.Is(err, ErrSchemaCodec) {
+		t.Fatalf("Validate() with the protobuf codec = %v, want ErrSchemaCodec", err)
+	}
+}
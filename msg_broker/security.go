@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsigned         = errors.New("message is not signed")
+	ErrBadSignature     = errors.New("message signature does not match")
+	ErrUnknownKey       = errors.New("unknown key")
+	ErrNoCurrentKey     = errors.New("keyring has no current key")
+	ErrNotEncrypted     = errors.New("message on an encrypted channel is not encrypted")
+	ErrEncryptedPayload = errors.New("payload is encrypted")
+)
+
+// SecurityError reports a message rejected because its signature or
+// encryption could not be verified. Consumers treat it as permanent.
+type SecurityError struct {
+	Channel string
+	Err     error
+}
+
+func (e *SecurityError) Error() string {
+	return fmt.Sprintf("[%s] message rejected: %v", e.Channel, e.Err)
+}
+
+func (e *SecurityError) Unwrap() error {
+	return e.Err
+}
+
+// Keyring holds keys by ID. New messages use the current key; any key in
+// the ring is accepted when verifying or decrypting, so keys are rotated by
+// adding the new key everywhere, making it current on publishers, and
+// removing the old one once no message can still carry it.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string][]byte)}
+}
+
+// Add registers key under id. The first key added becomes current.
+func (k *Keyring) Add(id string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+	if k.current == "" {
+		k.current = id
+	}
+}
+
+func (k *Keyring) SetCurrent(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	k.current = id
+	return nil
+}
+
+func (k *Keyring) Remove(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, id)
+	if k.current == id {
+		k.current = ""
+	}
+}
+
+func (k *Keyring) key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+func (k *Keyring) currentKey() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.current == "" {
+		return "", nil, ErrNoCurrentKey
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+// KeyringOptions describe a keyring in configuration: base64 encoded keys
+// by ID, and the ID of the current key, which may be omitted when there is
+// only one.
+type KeyringOptions struct {
+	Keys    map[string]string
+	Current string
+}
+
+// Keyring builds the described keyring, or returns nil if there are no
+// keys.
+func (o KeyringOptions) Keyring() (*Keyring, error) {
+	if len(o.Keys) == 0 {
+		return nil, nil
+	}
+	current := o.Current
+	if current == "" {
+		if len(o.Keys) > 1 {
+			return nil, errors.New("the current key must be named when there are several")
+		}
+		for id := range o.Keys {
+			current = id
+		}
+	}
+
+	keys := NewKeyring()
+	for id, encoded := range o.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		keys.Add(id, key)
+	}
+	if err := keys.SetCurrent(current); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// SetSigningKeys makes the publisher sign every envelope with HMAC-SHA256
+// using the keyring's current key.
+func (p *MessagePublisher) SetSigningKeys(keys *Keyring) {
+	p.signingKeys = keys
+}
+
+// SetChannelEncryption makes the publisher encrypt the payload of messages
+// on channel with AES-GCM using the keyring's current key, which must be
+// 16, 24 or 32 bytes long.
+func (p *MessagePublisher) SetChannelEncryption(channel string, keys *Keyring) {
+	p.encryption[channel] = keys
+}
+
+// SetSigningKeys makes the consumer reject messages that are unsigned,
+// signed with an unknown key or modified after signing.
+func (c *MessageConsumer) SetSigningKeys(keys *Keyring) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.signingKeys = keys
+}
+
+// SetChannelEncryption makes the consumer decrypt messages on channel, or
+// on a pattern registered with HandlePattern, and reject unencrypted ones.
+func (c *MessageConsumer) SetChannelEncryption(channel string, keys *Keyring) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encryption[channel] = keys
+}
+
+// signingInput covers every envelope field and the channel, each length
+// prefixed, so a signed message cannot be altered or moved to another
+// channel.
+func (e Envelope) signingInput(channel string) []byte {
+	var input []byte
+	field := func(value string) {
+		input = binary.BigEndian.AppendUint32(input, uint32(len(value)))
+		input = append(input, value...)
+	}
+	field("msg_broker/v1")
+	field(channel)
+	field(e.ID)
+	field(e.ProducedAt.UTC().Format(time.RFC3339Nano))
+	field(e.Producer)
+	field(e.ContentType)
+	field(strconv.Itoa(e.SchemaVersion))
+	field(e.KeyID)
+	field(e.EncryptionKeyID)
+	keys := make([]string, 0, len(e.Headers))
+	for key := range e.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	field(strconv.Itoa(len(keys)))
+	for _, key := range keys {
+		field(key)
+		field(e.Headers[key])
+	}
+	// Data is covered as encoding the envelope writes it, compacted and
+	// HTML-escaped, so the consumer sees the same bytes.
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		data = e.Data
+	}
+	field(string(data))
+	return input
+}
+
+func signature(key, input []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (e *Envelope) sign(keys *Keyring, channel string) error {
+	id, key, err := keys.currentKey()
+	if err != nil {
+		return err
+	}
+	e.KeyID = id
+	e.Signature = base64.StdEncoding.EncodeToString(signature(key, e.signingInput(channel)))
+	return nil
+}
+
+func (e Envelope) verify(keys *Keyring, channel string) error {
+	if e.Signature == "" {
+		return ErrUnsigned
+	}
+	key, err := keys.key(e.KeyID)
+	if err != nil {
+		return err
+	}
+	signed, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil || !hmac.Equal(signed, signature(key, e.signingInput(channel))) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the ciphertext to its channel and message ID.
+func additionalData(channel, id string) []byte {
+	return []byte(channel + "\x00" + id)
+}
+
+// encrypt replaces Data with the nonce and AES-GCM ciphertext of the codec
+// payload, stored base64 encoded like non-JSON payloads.
+func (e *Envelope) encrypt(keys *Keyring, channel string) error {
+	id, key, err := keys.currentKey()
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	payload, err := e.Payload()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(aead.Seal(nonce, nonce, payload, additionalData(channel, e.ID)))
+	if err != nil {
+		return err
+	}
+	e.Data = data
+	e.EncryptionKeyID = id
+	return nil
+}
+
+func (e *Envelope) decrypt(keys *Keyring, channel string) error {
+	key, err := keys.key(e.EncryptionKeyID)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	var sealed []byte
+	if err := json.Unmarshal(e.Data, &sealed); err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("encrypted payload is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, ciphertext, additionalData(channel, e.ID))
+	if err != nil {
+		return err
+	}
+
+	e.EncryptionKeyID = ""
+	if e.ContentType == ContentTypeJSON {
+		e.Data = payload
+		return nil
+	}
+	e.Data, err = json.Marshal(payload)
+	return err
+}
+
+// seal signs a new envelope for channel and, given a keyring, encrypts it.
+func (p *MessagePublisher) seal(envelope *Envelope, channel string, encryptionKeys *Keyring) error {
+	if encryptionKeys != nil {
+		if err := envelope.encrypt(encryptionKeys, channel); err != nil {
+			return err
+		}
+	}
+	if p.signingKeys != nil {
+		return envelope.sign(p.signingKeys, channel)
+	}
+	return nil
+}
+
+// openDelivery verifies and decrypts a delivery's envelope, leaving the
+// wire payload untouched for dead-lettering.
+func openDelivery(delivery Delivery, signingKeys, encryptionKeys *Keyring) (Delivery, error) {
+	if signingKeys != nil {
+		if err := delivery.Envelope.verify(signingKeys, delivery.Channel); err != nil {
+			return delivery, &SecurityError{Channel: delivery.Channel, Err: err}
+		}
+	}
+	if encryptionKeys == nil {
+		return delivery, nil
+	}
+	if delivery.Envelope.EncryptionKeyID == "" {
+		return delivery, &SecurityError{Channel: delivery.Channel, Err: ErrNotEncrypted}
+	}
+	envelope := delivery.Envelope
+	if err := envelope.decrypt(encryptionKeys, delivery.Channel); err != nil {
+		return delivery, &SecurityError{Channel: delivery.Channel, Err: err}
+	}
+	delivery.Envelope = envelope
+	return delivery, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func testKeyring(id, key string) *Keyring {
+	keys := NewKeyring()
+	keys.Add(id, []byte(key))
+	return keys
+}
+
+func sealedEnvelope(t *testing.T, channel string, signingKeys, encryptionKeys *Keyring) Envelope {
+	t.Helper()
+	publisher := NewMessagePublisher(NewMemoryBroker())
+	if signingKeys != nil {
+		publisher.SetSigningKeys(signingKeys)
+	}
+	if encryptionKeys != nil {
+		publisher.SetChannelEncryption(channel, encryptionKeys)
+	}
+	payload, err := publisher.serialize(Message{
+		Channel: channel,
+		Data:    map[string]interface{}{"amount": 100, "note": "<b>"},
+		Headers: map[string]string{"tenant": "acme"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newDelivery(channel, payload).Envelope
+}
+
+func TestSignAndVerify(t *testing.T) {
+	keys := testKeyring("k1", "signing secret")
+	envelope := sealedEnvelope(t, "payments", keys, nil)
+	if envelope.KeyID != "k1" || envelope.Signature == "" {
+		t.Fatalf("envelope is not signed: %+v", envelope)
+	}
+	if err := envelope.verify(keys, "payments"); err != nil {
+		t.Fatalf("verify() = %v", err)
+	}
+
+	tampered := []struct {
+		name   string
+		modify func(*Envelope)
+		want   error
+	}{
+		{"data", func(e *Envelope) { e.Data = json.RawMessage(`{"amount":1000,"note":"<b>"}`) }, ErrBadSignature},
+		{"header", func(e *Envelope) { e.Headers = map[string]string{"tenant": "evil"} }, ErrBadSignature},
+		{"id", func(e *Envelope) { e.ID = "other" }, ErrBadSignature},
+		{"signature", func(e *Envelope) { e.Signature = base64.StdEncoding.EncodeToString([]byte("forged")) }, ErrBadSignature},
+		{"unsigned", func(e *Envelope) { e.Signature = "" }, ErrUnsigned},
+		{"unknown key", func(e *Envelope) { e.KeyID = "k2" }, ErrUnknownKey},
+	}
+	for _, test := range tampered {
+		modified := envelope
+		test.modify(&modified)
+		if err := modified.verify(keys, "payments"); !errors.Is(err, test.want) {
+			t.Errorf("%s: verify() = %v, want %v", test.name, err, test.want)
+		}
+	}
+	if err := envelope.verify(keys, "refunds"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("verify() on another channel = %v, want ErrBadSignature", err)
+	}
+	if err := envelope.verify(testKeyring("k1", "other secret"), "payments"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("verify() with another key = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestSigningSurvivesJSONRoundTrip(t *testing.T) {
+	keys := testKeyring("k1", "signing secret")
+	envelope := sealedEnvelope(t, "payments", keys, nil)
+	wire, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeEnvelope(wire).verify(keys, "payments"); err != nil {
+		t.Fatalf("verify() after a round trip = %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keys := testKeyring("k1", "old secret")
+	old := sealedEnvelope(t, "payments", keys, nil)
+
+	keys.Add("k2", []byte("new secret"))
+	if err := keys.SetCurrent("k2"); err != nil {
+		t.Fatal(err)
+	}
+	current := sealedEnvelope(t, "payments", keys, nil)
+	if current.KeyID != "k2" {
+		t.Fatalf("signed with %q, want k2", current.KeyID)
+	}
+	if err := old.verify(keys, "payments"); err != nil {
+		t.Fatalf("old message rejected during rotation: %v", err)
+	}
+
+	keys.Remove("k1")
+	if err := old.verify(keys, "payments"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("verify() with a removed key = %v, want ErrUnknownKey", err)
+	}
+	if err := keys.SetCurrent("k1"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("SetCurrent() with a removed key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	keys := testKeyring("e1", "0123456789abcdef")
+	envelope := sealedEnvelope(t, "payments", nil, keys)
+	if envelope.EncryptionKeyID != "e1" {
+		t.Fatalf("envelope is not encrypted: %+v", envelope)
+	}
+	if _, err := envelope.Payload(); !errors.Is(err, ErrEncryptedPayload) {
+		t.Fatalf("Payload() of an encrypted envelope = %v, want ErrEncryptedPayload", err)
+	}
+
+	delivery, err := openDelivery(Delivery{Channel: "payments", Envelope: envelope}, nil, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Amount int    `json:"amount"`
+		Note   string `json:"note"`
+	}
+	if err := delivery.Envelope.Decode(&data); err != nil || data.Amount != 100 || data.Note != "<b>" {
+		t.Fatalf("Decode() = %+v, %v", data, err)
+	}
+
+	var sealed []byte
+	if err := json.Unmarshal(envelope.Data, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	flipped := envelope
+	flipped.Data, _ = json.Marshal(sealed)
+
+	for name, test := range map[string]struct {
+		delivery Delivery
+		keys     *Keyring
+	}{
+		"tampered ciphertext": {Delivery{Channel: "payments", Envelope: flipped}, keys},
+		"another channel":     {Delivery{Channel: "refunds", Envelope: envelope}, keys},
+		"another key":         {Delivery{Channel: "payments", Envelope: envelope}, testKeyring("e1", "fedcba9876543210")},
+		"unknown key":         {Delivery{Channel: "payments", Envelope: envelope}, testKeyring("e2", "0123456789abcdef")},
+	} {
+		var securityErr *SecurityError
+		if _, err := openDelivery(test.delivery, nil, test.keys); !errors.As(err, &securityErr) {
+			t.Errorf("%s: openDelivery() = %v, want a SecurityError", name, err)
+		}
+	}
+}
+
+func TestOpenDeliveryRejectsPlaintextOnEncryptedChannel(t *testing.T) {
+	envelope := sealedEnvelope(t, "payments", nil, nil)
+	_, err := openDelivery(Delivery{Channel: "payments", Envelope: envelope}, nil, testKeyring("e1", "0123456789abcdef"))
+	if !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("openDelivery() = %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestSignedAndEncrypted(t *testing.T) {
+	signingKeys := testKeyring("k1", "signing secret")
+	encryptionKeys := testKeyring("e1", "0123456789abcdef0123456789abcdef")
+	envelope := sealedEnvelope(t, "payments", signingKeys, encryptionKeys)
+
+	delivery := Delivery{Channel: "payments", Envelope: envelope}
+	if _, err := openDelivery(delivery, signingKeys, encryptionKeys); err != nil {
+		t.Fatalf("openDelivery() = %v", err)
+	}
+	// The signature covers the ciphertext and the encryption key ID.
+	delivery.Envelope.EncryptionKeyID = "e2"
+	if _, err := openDelivery(delivery, signingKeys, encryptionKeys); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("openDelivery() with a changed key ID = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestKeyringOptions(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	if keys, err := (KeyringOptions{}).Keyring(); keys != nil || err != nil {
+		t.Fatalf("Keyring() without keys = %v, %v; want nil, nil", keys, err)
+	}
+	keys, err := KeyringOptions{Keys: map[string]string{"e1": key}}.Keyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, err := keys.currentKey(); err != nil || id != "e1" {
+		t.Fatalf("currentKey() = %q, %v; want e1", id, err)
+	}
+
+	for name, options := range map[string]KeyringOptions{
+		"several keys without current": {Keys: map[string]string{"e1": key, "e2": key}},
+		"unknown current":              {Keys: map[string]string{"e1": key}, Current: "e2"},
+		"invalid base64":               {Keys: map[string]string{"e1": "not base64!"}},
+	} {
+		if _, err := options.Keyring(); err == nil {
+			t.Errorf("%s: Keyring() accepted invalid options", name)
+		}
+	}
+}
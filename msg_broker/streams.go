@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type Transport string
+
+const (
+	TransportPubSub  Transport = "pubsub"
+	TransportStreams Transport = "streams"
+)
+
+const streamDataField = "data"
+
+type StreamOptions struct {
+	Group         string
+	Consumer      string
+	MaxLen        int64
+	BatchSize     int64
+	BlockTimeout  time.Duration
+	ClaimMinIdle  time.Duration
+	ClaimInterval time.Duration
+	MaxDeliveries int
+}
+
+// The streams transport is Redis-only; NewStreamPublisher and
+// NewStreamConsumer only accept a Redis broker.
+func (c *MessageConsumer) streamClient() redis.UniversalClient {
+	return c.broker.(Redis).RedisClient
+}
+
+func streamKey(channel string) string {
+	return "stream:" + channel
+}
+
+func (p *MessagePublisher) streamArgs(channel string, payload []byte) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: streamKey(channel),
+		MaxLen: p.streams.MaxLen,
+		Approx: p.streams.MaxLen > 0,
+		Values: map[string]interface{}{streamDataField: payload},
+	}
+}
+
+func (p *MessagePublisher) publishStream(ctx context.Context, channel string, payload []byte) error {
+	return p.broker.(Redis).RedisClient.XAdd(ctx, p.streamArgs(channel, payload)).Err()
+}
+
+func (c *MessageConsumer) consumeStream(ctx, handlerCtx context.Context, channel string) {
+	client := c.streamClient()
+	stream := streamKey(channel)
+
+	if err := c.createGroup(ctx, stream); err != nil {
+		log.Printf("[%s] Failed to create consumer group %s: %v", channel, c.streams.Group, err)
+		if !c.recoverStream(ctx, channel, stream) {
+			return
+		}
+	}
+
+	log.Printf("[%s] Stream consumer %s started listening in group %s...\n", channel, c.streams.Consumer, c.streams.Group)
+
+	// Entries delivered to this consumer before a restart are still pending,
+	// so drain them first and only then switch to new entries. The drain
+	// moves past every entry it reads, failed or not: retrying them is left
+	// to reclaimStream once they have been idle for ClaimMinIdle.
+	lastID := "0"
+	var lastClaim time.Time
+
+	for {
+		if ctx.Err() != nil {
+			log.Printf("[%s] Stream consumer stopped listening...\n", channel)
+			c.clearHealth(channel)
+			return
+		}
+
+		if time.Since(lastClaim) >= c.streams.ClaimInterval {
+			c.reclaimStream(handlerCtx, channel, stream)
+			lastClaim = time.Now()
+		}
+
+		streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.streams.Group,
+			Consumer: c.streams.Consumer,
+			Streams:  []string{stream, lastID},
+			Count:    c.streams.BatchSize,
+			Block:    c.streams.BlockTimeout,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			log.Printf("[%s] Failed to read from stream: %v", channel, err)
+			if !c.recoverStream(ctx, channel, stream) {
+				return
+			}
+			continue
+		}
+
+		received := 0
+		for _, s := range streams {
+			for _, message := range s.Messages {
+				c.handleStreamMessage(handlerCtx, channel, stream, message)
+				if lastID != ">" {
+					lastID = message.ID
+				}
+				received++
+			}
+		}
+		if lastID != ">" && received == 0 {
+			lastID = ">"
+		}
+	}
+}
+
+// createGroup also recreates the group after Redis lost its data, which
+// otherwise surfaces as NOGROUP errors on every read.
+func (c *MessageConsumer) createGroup(ctx context.Context, stream string) error {
+	err := c.streamClient().XGroupCreateMkStream(ctx, stream, c.streams.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (c *MessageConsumer) recoverStream(ctx context.Context, channel, stream string) bool {
+	err := c.reconnectWithBackoff(ctx, channel, func() error {
+		return c.createGroup(ctx, stream)
+	})
+	if err != nil {
+		log.Printf("[%s] Stream consumer stopped listening: %v", channel, err)
+		if ctx.Err() != nil {
+			c.clearHealth(channel)
+		}
+		return false
+	}
+	return true
+}
+
+// reclaimStream takes over entries that another consumer of the group read
+// but never acknowledged, e.g. because it crashed mid-processing.
+func (c *MessageConsumer) reclaimStream(ctx context.Context, channel, stream string) {
+	start := "0-0"
+	for {
+		messages, next, err := c.streamClient().XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    c.streams.Group,
+			Consumer: c.streams.Consumer,
+			MinIdle:  c.streams.ClaimMinIdle,
+			Start:    start,
+			Count:    c.streams.BatchSize,
+		}).Result()
+		if err != nil {
+			log.Printf("[%s] Failed to reclaim pending messages: %v", channel, err)
+			return
+		}
+		for _, message := range messages {
+			c.handleStreamMessage(ctx, channel, stream, message)
+		}
+		if next == "0-0" || next == start {
+			return
+		}
+		start = next
+	}
+}
+
+func (c *MessageConsumer) handleStreamMessage(ctx context.Context, channel, stream string, message redis.XMessage) {
+	payload, _ := message.Values[streamDataField].(string)
+	delivery := newDelivery(channel, []byte(payload))
+	err := c.dispatch(ctx, delivery)
+
+	// Handler failures stay pending so the entry is retried once reclaimed,
+	// until it has been delivered MaxDeliveries times. Messages that can
+	// never be handled are dead-lettered straight away.
+	if err != nil {
+		attempts := 1
+		if !isPermanent(err) {
+			attempts = c.deliveryCount(ctx, stream, message.ID)
+			if attempts < c.streams.MaxDeliveries {
+				return
+			}
+		}
+		c.sendToDeadLetter(ctx, delivery, err, attempts)
+	}
+
+	err = c.streamClient().XAck(ctx, stream, c.streams.Group, message.ID).Err()
+	if err != nil {
+		log.Printf("[%s] Failed to acknowledge message %s: %v", channel, message.ID, err)
+	}
+}
+
+func (c *MessageConsumer) deliveryCount(ctx context.Context, stream, id string) int {
+	pending, err := c.streamClient().XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  c.streams.Group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return 1
+	}
+	return int(pending[0].RetryCount)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) Redis {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return Redis{RedisClient: client}
+}
+
+func TestStreamHistoryDrainDoesNotRetryImmediately(t *testing.T) {
+	broker := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := StreamOptions{
+		Group:         "workers",
+		Consumer:      "worker-1",
+		BatchSize:     10,
+		BlockTimeout:  20 * time.Millisecond,
+		ClaimMinIdle:  time.Hour,
+		ClaimInterval: time.Hour,
+		MaxDeliveries: 3,
+	}
+	if _, err := NewStreamPublisher(broker, options).PublishMessages(ctx, Message{Channel: "orders", Data: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Leave the entry pending for this consumer, as after a crash.
+	client := broker.RedisClient
+	if err := client.XGroupCreateMkStream(ctx, streamKey("orders"), options.Group, "0").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    options.Group,
+		Consumer: options.Consumer,
+		Streams:  []string{streamKey("orders"), ">"},
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	consumer := NewStreamConsumer(broker, options)
+	consumer.OnError(func(context.Context, Delivery, error) {})
+	consumer.Handle("orders", func(context.Context, Delivery) error {
+		calls.Add(1)
+		return errors.New("temporarily unavailable")
+	})
+	if err := consumer.Start(ctx, []string{"orders"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := consumer.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("handler called %d times, want 1", got)
+	}
+	pending, err := client.XPending(ctx, streamKey("orders"), options.Group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 1 {
+		t.Fatalf("%d entries pending, want 1", pending.Count)
+	}
+}
+
+func TestStreamConsumerStartStop(t *testing.T) {
+	broker := newTestRedis(t)
+	ctx := context.Background()
+	options := StreamOptions{
+		Group:         "workers",
+		Consumer:      "worker-1",
+		BatchSize:     10,
+		BlockTimeout:  10 * time.Millisecond,
+		ClaimMinIdle:  time.Minute,
+		ClaimInterval: time.Minute,
+		MaxDeliveries: 3,
+	}
+	consumer := NewStreamConsumer(broker, options)
+	consumer.Handle("orders", func(context.Context, Delivery) error { return nil })
+
+	for i := 0; i < 5; i++ {
+		if err := consumer.Start(ctx, []string{"orders"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := consumer.Subscribe(ctx, "payments"); err != nil {
+			t.Fatal(err)
+		}
+		if err := consumer.Stop(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -2,55 +2,474 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var ErrConsumerStarted = errors.New("consumer already started")
+
 type MessageConsumer struct {
-	redisClient  Redis
-	subscription *redis.PubSub
+	broker          Broker
+	transport       Transport
+	streams         StreamOptions
+	mu              sync.RWMutex
+	handlers        map[string]Handler
+	patternHandlers map[string]Handler
+	errorHandler    ErrorHandler
+	cancel          context.CancelFunc
+	handlerCancel   context.CancelFunc
+	reconnect       ReconnectOptions
+	health          map[string]HealthState
+	healthHandler   func(HealthState)
+	deadLetters     *DeadLetterQueue
+	middleware      []Middleware
+	metrics         *Metrics
+	tracer          trace.Tracer
+	deduplication   DeduplicationOptions
+	schemas         map[string]*jsonschema.Schema
+	signingKeys     *Keyring
+	encryption      map[string]*Keyring
+
+	workerOptions        WorkerOptions
+	channelWorkerOptions map[string]WorkerOptions
+
+	// subscriptionMu guards the fields below. c.mu may be taken while
+	// holding it, never the other way round.
+	subscriptionMu sync.Mutex
+	subscription   Subscription
+	// generation identifies the receive loop that owns subscription, so a
+	// loop left running by a timed-out Stop cannot touch its successor's.
+	generation         int
+	subscribedPatterns []string
+	channels           map[string]struct{}
+	streamCancels      map[string]context.CancelFunc
+	counted            int
+	receiveCtx         context.Context
+	handlerCtx         context.Context
+	// loops tracks the receive loops of the current run only, so a Start
+	// after a timed-out Stop never reuses a WaitGroup still being waited on.
+	loops *sync.WaitGroup
+}
+
+var defaultReconnectOptions = ReconnectOptions{
+	MinBackoff:   100 * time.Millisecond,
+	MaxBackoff:   30 * time.Second,
+	PingInterval: 15 * time.Second,
+}
+
+func NewMessageConsumer(broker Broker) *MessageConsumer {
+	return &MessageConsumer{
+		broker:               broker,
+		transport:            TransportPubSub,
+		handlers:             make(map[string]Handler),
+		patternHandlers:      make(map[string]Handler),
+		errorHandler:         logError,
+		reconnect:            defaultReconnectOptions,
+		health:               make(map[string]HealthState),
+		tracer:               defaultTracer(),
+		schemas:              make(map[string]*jsonschema.Schema),
+		encryption:           make(map[string]*Keyring),
+		workerOptions:        defaultWorkerOptions,
+		channelWorkerOptions: make(map[string]WorkerOptions),
+		channels:             make(map[string]struct{}),
+		streamCancels:        make(map[string]context.CancelFunc),
+	}
 }
 
-func NewMessageConsumer(redis Redis) *MessageConsumer {
+func NewStreamConsumer(redisClient Redis, streams StreamOptions) *MessageConsumer {
 	return &MessageConsumer{
-		redisClient: redis,
+		broker:               redisClient,
+		transport:            TransportStreams,
+		streams:              streams,
+		handlers:             make(map[string]Handler),
+		patternHandlers:      make(map[string]Handler),
+		errorHandler:         logError,
+		reconnect:            defaultReconnectOptions,
+		health:               make(map[string]HealthState),
+		tracer:               defaultTracer(),
+		schemas:              make(map[string]*jsonschema.Schema),
+		encryption:           make(map[string]*Keyring),
+		workerOptions:        defaultWorkerOptions,
+		channelWorkerOptions: make(map[string]WorkerOptions),
+		channels:             make(map[string]struct{}),
+		streamCancels:        make(map[string]context.CancelFunc),
+	}
+}
+
+// Start subscribes to channels and returns immediately. Receiving stops when
+// ctx is cancelled or Stop is called; handlers keep their own context so
+// messages already being handled can finish during Stop.
+//
+// On pub/sub all channels and patterns share a single subscription, read
+// by one receive loop; channels can be added and removed while running
+// with Subscribe and Unsubscribe.
+func (c *MessageConsumer) Start(ctx context.Context, channels []string) error {
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.mu.Unlock()
+		return ErrConsumerStarted
+	}
+	if c.transport == TransportStreams && len(c.patternHandlers) > 0 {
+		c.mu.Unlock()
+		return ErrPatternsUnsupported
+	}
+	receiveCtx, cancel := context.WithCancel(ctx)
+	handlerCtx, handlerCancel := context.WithCancel(context.WithoutCancel(ctx))
+	c.cancel = cancel
+	c.handlerCancel = handlerCancel
+	patterns := c.patterns()
+	c.mu.Unlock()
+
+	c.subscriptionMu.Lock()
+	defer c.subscriptionMu.Unlock()
+	for _, channel := range channels {
+		c.channels[channel] = struct{}{}
+	}
+
+	if c.transport == TransportStreams {
+		c.receiveCtx, c.handlerCtx, c.loops = receiveCtx, handlerCtx, new(sync.WaitGroup)
+		for channel := range c.channels {
+			c.startStreamLocked(channel)
+		}
+		return nil
+	}
+
+	// A loop whose Stop timed out may still own the subscription; it exits
+	// once it sees it is no longer the current generation.
+	if c.subscription != nil {
+		c.subscription.Close()
+		c.subscription = nil
+		c.countSubscriptionsLocked(-c.counted)
+	}
+	c.generation++
+	generation := c.generation
+
+	subscription, err := c.openSubscription(receiveCtx, c.channelsLocked(), patterns)
+	if err != nil {
+		c.mu.Lock()
+		c.cancel, c.handlerCancel = nil, nil
+		c.mu.Unlock()
+		cancel()
+		handlerCancel()
+		return err
+	}
+	c.receiveCtx, c.handlerCtx, c.loops = receiveCtx, handlerCtx, new(sync.WaitGroup)
+	c.subscription = subscription
+	c.subscribedPatterns = patterns
+	for _, name := range append(c.channelsLocked(), patterns...) {
+		log.Printf("[%s] Consumer started listening...\n", name)
+	}
+	c.countSubscriptionsLocked(len(c.channels) + len(patterns))
+
+	c.setHealth(pubSubLoop, HealthConnected)
+	loops := c.loops
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		c.handleCustomType1Logic(receiveCtx, handlerCtx, generation)
+	}()
+	return nil
+}
+
+// pubSubLoop names the shared pub/sub receive loop in health reports.
+const pubSubLoop = "pubsub"
+
+// openSubscription subscribes to channels and patterns on one subscription.
+func (c *MessageConsumer) openSubscription(ctx context.Context, channels, patterns []string) (Subscription, error) {
+	if len(channels) == 0 && len(patterns) > 0 {
+		return c.broker.PSubscribe(ctx, patterns...)
+	}
+	subscription, err := c.broker.Subscribe(ctx, channels...)
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) > 0 {
+		if err := subscription.PSubscribe(ctx, patterns...); err != nil {
+			subscription.Close()
+			return nil, err
+		}
+	}
+	return subscription, nil
+}
+
+// startStreamLocked runs a stream consumer loop for channel that stops when
+// the consumer stops or the channel is unsubscribed.
+func (c *MessageConsumer) startStreamLocked(channel string) {
+	ctx, cancel := context.WithCancel(c.receiveCtx)
+	handlerCtx, loops := c.handlerCtx, c.loops
+	c.streamCancels[channel] = cancel
+
+	c.mu.RLock()
+	metrics := c.metrics
+	c.mu.RUnlock()
+
+	c.setHealth(channel, HealthConnected)
+	loops.Add(1)
+	metrics.subscriptionsChanged(1)
+	go func() {
+		defer loops.Done()
+		defer metrics.subscriptionsChanged(-1)
+		defer cancel()
+		c.consumeStream(ctx, handlerCtx, channel)
+	}()
+}
+
+// Subscribe adds channels to the consumer. Before Start they are merely
+// recorded; while running they are subscribed on the existing connection.
+// If the broker rejects the subscription the channels stay registered and
+// are subscribed again with everything else after a reconnect.
+func (c *MessageConsumer) Subscribe(ctx context.Context, channels ...string) error {
+	c.subscriptionMu.Lock()
+	defer c.subscriptionMu.Unlock()
+
+	added := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		if _, ok := c.channels[channel]; !ok {
+			c.channels[channel] = struct{}{}
+			added = append(added, channel)
+		}
+	}
+	if len(added) == 0 || c.receiveCtx == nil {
+		return nil
+	}
+
+	if c.transport == TransportStreams {
+		for _, channel := range added {
+			c.startStreamLocked(channel)
+		}
+		return nil
+	}
+
+	c.countSubscriptionsLocked(len(added))
+
+	if c.subscription == nil {
+		return nil
+	}
+	if err := c.subscription.Subscribe(ctx, added...); err != nil {
+		return err
+	}
+	for _, channel := range added {
+		log.Printf("[%s] Consumer started listening...\n", channel)
 	}
+	return nil
 }
 
-func (c *MessageConsumer) ConsumerMessages(ctx context.Context, channels []string) {
+// Unsubscribe removes channels from the consumer. Messages for them that
+// were already received are still handled.
+func (c *MessageConsumer) Unsubscribe(ctx context.Context, channels ...string) error {
+	c.subscriptionMu.Lock()
+	defer c.subscriptionMu.Unlock()
+
+	removed := make([]string, 0, len(channels))
 	for _, channel := range channels {
-		go c.handleCustomType1Logic(ctx, channel)
+		if _, ok := c.channels[channel]; ok {
+			delete(c.channels, channel)
+			removed = append(removed, channel)
+		}
+	}
+	if len(removed) == 0 || c.receiveCtx == nil {
+		return nil
+	}
+
+	if c.transport == TransportStreams {
+		for _, channel := range removed {
+			c.streamCancels[channel]()
+			delete(c.streamCancels, channel)
+		}
+		return nil
 	}
+
+	c.countSubscriptionsLocked(-len(removed))
+
+	if c.subscription == nil {
+		return nil
+	}
+	if err := c.subscription.Unsubscribe(ctx, removed...); err != nil {
+		return err
+	}
+	for _, channel := range removed {
+		log.Printf("[%s] Consumer stopped listening...\n", channel)
+	}
+	return nil
 }
 
-func (c *MessageConsumer) handleCustomType1Logic(ctx context.Context, channel string) {
-	consumerCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// countSubscriptionsLocked keeps the active subscriptions gauge in step
+// with the pub/sub subscription; counted is what this consumer added.
+func (c *MessageConsumer) countSubscriptionsLocked(delta int) {
+	c.mu.RLock()
+	metrics := c.metrics
+	c.mu.RUnlock()
+	c.counted += delta
+	metrics.subscriptionsChanged(delta)
+}
 
-	log.Printf("[%s] Consumer started listening...\n", channel)
+// Channels returns the subscribed channels, sorted.
+func (c *MessageConsumer) Channels() []string {
+	c.subscriptionMu.Lock()
+	defer c.subscriptionMu.Unlock()
+	return c.channelsLocked()
+}
 
-	c.subscription = c.redisClient.RedisClient.Subscribe(channel)
-	defer c.subscription.Close()
+func (c *MessageConsumer) channelsLocked() []string {
+	channels := make([]string, 0, len(c.channels))
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
 
-	messageChannel := c.subscription.Channel()
+// Stop stops receiving and waits for in-flight handlers until ctx is done,
+// at which point their context is cancelled and ctx.Err() is returned.
+func (c *MessageConsumer) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	cancel, handlerCancel := c.cancel, c.handlerCancel
+	c.cancel, c.handlerCancel = nil, nil
+	c.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	defer handlerCancel()
+	cancel()
+
+	c.subscriptionMu.Lock()
+	loops := c.loops
+	c.receiveCtx, c.handlerCtx, c.loops = nil, nil, nil
+	for channel, cancel := range c.streamCancels {
+		cancel()
+		delete(c.streamCancels, channel)
+	}
+	c.subscriptionMu.Unlock()
+	if loops == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ownedSubscriptionLocked returns the subscription if the loop of
+// generation still owns it, or nil.
+func (c *MessageConsumer) ownedSubscriptionLocked(generation int) Subscription {
+	if c.generation != generation {
+		return nil
+	}
+	return c.subscription
+}
+
+func (c *MessageConsumer) handleCustomType1Logic(ctx, handlerCtx context.Context, generation int) {
+	// Receive does not watch ctx, so closing the subscription is what
+	// interrupts a pending read on shutdown.
+	stop := context.AfterFunc(ctx, func() {
+		c.subscriptionMu.Lock()
+		defer c.subscriptionMu.Unlock()
+		if subscription := c.ownedSubscriptionLocked(generation); subscription != nil {
+			subscription.Close()
+		}
+	})
+	defer stop()
+	defer func() {
+		c.subscriptionMu.Lock()
+		defer c.subscriptionMu.Unlock()
+		if subscription := c.ownedSubscriptionLocked(generation); subscription != nil {
+			subscription.Close()
+			c.subscription = nil
+			c.countSubscriptionsLocked(-c.counted)
+		}
+	}()
+
+	c.mu.RLock()
+	pingInterval := c.reconnect.PingInterval
+	c.mu.RUnlock()
+
+	// Each channel, or pattern, gets its own worker pool so a slow handler
+	// only holds back its own messages. Buffered messages are still handled
+	// after receiving stops.
+	pools := make(map[string]*workerPool)
+	var workers sync.WaitGroup
+	defer func() {
+		for _, pool := range pools {
+			pool.close()
+		}
+		workers.Wait()
+	}()
 
 	for {
-		select {
-		case <-consumerCtx.Done():
-			log.Printf("[%s] Consumer stopped listening...\n", channel)
+		c.subscriptionMu.Lock()
+		subscription := c.ownedSubscriptionLocked(generation)
+		c.subscriptionMu.Unlock()
+		if subscription == nil {
+			log.Printf("[%s] Consumer stopped listening...\n", pubSubLoop)
 			return
-		case msg := <-messageChannel:
-			var messageData interface{}
-			err := json.Unmarshal([]byte(msg.Payload), &messageData)
+		}
+
+		msg, err := subscription.Receive(pingInterval)
+		if ctx.Err() != nil {
+			log.Printf("[%s] Consumer stopped listening...\n", pubSubLoop)
+			c.subscriptionMu.Lock()
+			if c.generation == generation {
+				c.clearHealth(pubSubLoop)
+			}
+			c.subscriptionMu.Unlock()
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] Lost connection to broker: %v", pubSubLoop, err)
+			err = c.reconnectWithBackoff(ctx, pubSubLoop, func() error {
+				c.subscriptionMu.Lock()
+				defer c.subscriptionMu.Unlock()
+				current := c.ownedSubscriptionLocked(generation)
+				if current == nil {
+					return context.Canceled
+				}
+				resubscribed, err := c.openSubscription(ctx, c.channelsLocked(), c.subscribedPatterns)
+				if err != nil {
+					return err
+				}
+				current.Close()
+				c.subscription = resubscribed
+				if ctx.Err() != nil {
+					c.subscription.Close()
+				}
+				return nil
+			})
 			if err != nil {
-				log.Printf("[%s] Failed to deserialize message: %v", channel, err)
-				continue
+				log.Printf("[%s] Consumer stopped listening: %v", pubSubLoop, err)
+				if ctx.Err() != nil {
+					c.clearHealth(pubSubLoop)
+				}
+				return
 			}
+			continue
+		}
 
-			fmt.Printf("[%s] Received message: %+v\n", channel, messageData)
+		delivery := newDelivery(msg.Channel, msg.Payload)
+		delivery.Pattern = msg.Pattern
+		name := delivery.Channel
+		if delivery.Pattern != "" {
+			name = delivery.Pattern
+		}
+		pool, ok := pools[name]
+		if !ok {
+			pool = c.startWorkerPool(handlerCtx, name, &workers)
+			pools[name] = pool
 		}
+		pool.submit(ctx, delivery)
 	}
 }
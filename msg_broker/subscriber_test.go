@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConsumerHandlesChannelsAndPatterns(t *testing.T) {
+	broker := NewMemoryBroker()
+	consumer := NewMessageConsumer(broker)
+	publisher := NewMessagePublisher(broker)
+
+	received := make(chan string, 10)
+	consumer.Handle("orders", TypedHandler(func(ctx context.Context, id int) error {
+		delivery, _ := DeliveryFromContext(ctx)
+		received <- fmt.Sprintf("%s %d", delivery.Channel, id)
+		return nil
+	}))
+	consumer.HandlePattern("events.*", func(ctx context.Context, delivery Delivery) error {
+		received <- delivery.Pattern + " " + delivery.Channel
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := consumer.Start(ctx, []string{"orders"}); err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Stop(ctx)
+
+	for _, message := range []Message{
+		{Channel: "orders", Data: 1},
+		{Channel: "events.created", Data: "x"},
+		{Channel: "other", Data: "y"},
+	} {
+		if _, err := publisher.PublishMessages(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case message := <-received:
+			got[message] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want two messages", got)
+		}
+	}
+	if !got["orders 1"] || !got["events.* events.created"] {
+		t.Fatalf("received %v", got)
+	}
+}
+
+func TestRestartAfterStopTimeout(t *testing.T) {
+	broker := NewMemoryBroker()
+	consumer := NewMessageConsumer(broker)
+	publisher := NewMessagePublisher(broker)
+
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	consumer.Handle("orders", func(ctx context.Context, delivery Delivery) error {
+		received <- delivery.Envelope.ID
+		if delivery.Envelope.ID == "slow" {
+			<-release
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := consumer.Start(ctx, []string{"orders"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.PublishMessages(ctx, Message{Channel: "orders", Data: 1, ID: "slow"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, received, "slow")
+
+	stopCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := consumer.Stop(stopCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop() = %v, want deadline exceeded", err)
+	}
+	if err := consumer.Start(ctx, []string{"orders"}); err != nil {
+		t.Fatal(err)
+	}
+	// Let the first loop exit while the second one is running.
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	receivers, err := publisher.PublishMessages(ctx, Message{Channel: "orders", Data: 2, ID: "after"})
+	if err != nil || receivers != 1 {
+		t.Fatalf("PublishMessages() = %d, %v, want 1 receiver", receivers, err)
+	}
+	waitFor(t, received, "after")
+	if err := consumer.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, received <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-received:
+		if got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
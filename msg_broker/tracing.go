@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "msg_broker"
+
+// traceContext is used directly rather than through otel's global
+// propagator, which is a no-op until the application configures one.
+var traceContext = propagation.TraceContext{}
+
+// SetTracerProvider overrides the global OpenTelemetry tracer provider.
+// Without one, spans are not recorded but trace context still propagates.
+func (p *MessagePublisher) SetTracerProvider(provider trace.TracerProvider) {
+	p.tracer = provider.Tracer(tracerName)
+}
+
+func (c *MessageConsumer) SetTracerProvider(provider trace.TracerProvider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tracer = provider.Tracer(tracerName)
+}
+
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// startPublishSpan starts a producer span for message and injects its
+// context into a copy of the message headers.
+func (p *MessagePublisher) startPublishSpan(ctx context.Context, message Message) (context.Context, trace.Span, Message) {
+	ctx, span := p.tracer.Start(ctx, message.Channel+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messagingAttributes(message.Channel, "publish")...),
+	)
+	return ctx, span, injectTraceContext(ctx, message)
+}
+
+// injectTraceContext copies the headers so the caller's map is not
+// modified.
+func injectTraceContext(ctx context.Context, message Message) Message {
+	headers := make(map[string]string, len(message.Headers)+2)
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	traceContext.Inject(ctx, propagation.MapCarrier(headers))
+	if len(headers) > 0 {
+		message.Headers = headers
+	}
+	return message
+}
+
+// startConsumeSpan starts a consumer span that is a child of the trace
+// context the publisher put in the envelope headers, if any.
+func startConsumeSpan(ctx context.Context, tracer trace.Tracer, delivery Delivery) (context.Context, trace.Span) {
+	if delivery.Envelope.Headers != nil {
+		ctx = traceContext.Extract(ctx, propagation.MapCarrier(delivery.Envelope.Headers))
+	}
+	attributes := messagingAttributes(delivery.Channel, "process")
+	if delivery.Envelope.ID != "" {
+		attributes = append(attributes, attribute.String("messaging.message.id", delivery.Envelope.ID))
+	}
+	return tracer.Start(ctx, delivery.Channel+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes...),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func messagingAttributes(channel, operation string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "redis"),
+		attribute.String("messaging.destination.name", channel),
+		attribute.String("messaging.operation", operation),
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to a message received while its
+// channel's buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock stops receiving until a worker frees a slot, which
+	// holds back every channel sharing the consumer's subscription.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered message.
+	OverflowDropOldest
+	// OverflowDropNewest discards the message just received.
+	OverflowDropNewest
+	// OverflowSpill pushes the message to the "spill:<scope>:<channel>"
+	// list; idle workers take it back once the buffer has drained.
+	OverflowSpill
+)
+
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "block", "":
+		return OverflowBlock, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	case "spill":
+		return OverflowSpill, nil
+	}
+	return OverflowBlock, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// WorkerOptions configure how the pub/sub messages of one channel (or
+// pattern) are handled. A single worker keeps the channel's messages in
+// order; more workers handle them concurrently.
+type WorkerOptions struct {
+	Workers    int
+	BufferSize int
+	Overflow   OverflowPolicy
+	// Scope separates the spill lists of consumers that each get their own
+	// copy of a channel's messages, such as two services subscribed to it;
+	// consumers sharing a scope also share spilled messages. Channel
+	// options without a scope use the default options' scope.
+	Scope string
+}
+
+var defaultWorkerOptions = WorkerOptions{Workers: 1, BufferSize: 100}
+
+// SetWorkerOptions sets the default worker options for channels without
+// options of their own. They apply to pools created after the call, i.e.
+// from the next Start.
+func (c *MessageConsumer) SetWorkerOptions(options WorkerOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workerOptions = options
+}
+
+// SetChannelWorkerOptions sets the worker options for a channel, or for a
+// pattern registered with HandlePattern.
+func (c *MessageConsumer) SetChannelWorkerOptions(channel string, options WorkerOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channelWorkerOptions[channel] = options
+}
+
+func (c *MessageConsumer) workerOptionsFor(name string) WorkerOptions {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	options, ok := c.channelWorkerOptions[name]
+	if !ok {
+		options = c.workerOptions
+	}
+	if options.Scope == "" {
+		options.Scope = c.workerOptions.Scope
+	}
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.BufferSize <= 0 {
+		options.BufferSize = defaultWorkerOptions.BufferSize
+	}
+	return options
+}
+
+func spillKey(scope, name string) string {
+	return "spill:" + scope + ":" + name
+}
+
+// spilledMessage keeps the pattern of a spilled delivery, which the payload
+// alone would lose.
+type spilledMessage struct {
+	Channel string `json:"channel"`
+	Pattern string `json:"pattern,omitempty"`
+	Payload []byte `json:"payload"`
+}
+
+// workerPool buffers the deliveries of one channel or pattern and hands
+// them to a fixed number of workers.
+type workerPool struct {
+	name     string
+	options  WorkerOptions
+	consumer *MessageConsumer
+	queue    chan Delivery
+	spilled  atomic.Bool
+}
+
+func (c *MessageConsumer) startWorkerPool(handlerCtx context.Context, name string, workers *sync.WaitGroup) *workerPool {
+	options := c.workerOptionsFor(name)
+	pool := &workerPool{
+		name:     name,
+		options:  options,
+		consumer: c,
+		queue:    make(chan Delivery, options.BufferSize),
+	}
+	// Messages spilled before a restart are picked up by the first idle
+	// worker.
+	pool.spilled.Store(options.Overflow == OverflowSpill)
+	for i := 0; i < options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			pool.work(handlerCtx)
+		}()
+	}
+	return pool
+}
+
+// submit queues delivery, applying the overflow policy when the buffer is
+// full. It only blocks under OverflowBlock, until ctx is done.
+func (p *workerPool) submit(ctx context.Context, delivery Delivery) {
+	select {
+	case p.queue <- delivery:
+		return
+	default:
+	}
+
+	switch p.options.Overflow {
+	case OverflowDropNewest:
+		p.drop(delivery, "drop-newest")
+	case OverflowDropOldest:
+		for {
+			select {
+			case p.queue <- delivery:
+				return
+			default:
+			}
+			select {
+			case oldest := <-p.queue:
+				p.drop(oldest, "drop-oldest")
+			default:
+			}
+		}
+	case OverflowSpill:
+		err := p.spill(ctx, delivery)
+		if err == nil {
+			return
+		}
+		log.Printf("[%s] Failed to spill message, blocking instead: %v", p.name, err)
+		fallthrough
+	default:
+		select {
+		case p.queue <- delivery:
+		case <-ctx.Done():
+			p.drop(delivery, "shutdown")
+		}
+	}
+}
+
+func (p *workerPool) drop(delivery Delivery, reason string) {
+	log.Printf("[%s] Dropped message %s (%s)", p.name, delivery.Envelope.ID, reason)
+	p.consumer.mu.RLock()
+	metrics := p.consumer.metrics
+	p.consumer.mu.RUnlock()
+	metrics.observeDrop(delivery.Channel, reason)
+}
+
+func (p *workerPool) spill(ctx context.Context, delivery Delivery) error {
+	lists, err := listBroker(p.consumer.broker)
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(spilledMessage{
+		Channel: delivery.Channel,
+		Pattern: delivery.Pattern,
+		Payload: delivery.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	if err := lists.Push(ctx, spillKey(p.options.Scope, p.name), serialized); err != nil {
+		return err
+	}
+	p.spilled.Store(true)
+	return nil
+}
+
+// unspill pops the oldest spilled message, clearing the spilled flag once
+// the list is empty.
+func (p *workerPool) unspill(ctx context.Context) (Delivery, bool) {
+	lists, err := listBroker(p.consumer.broker)
+	if err != nil {
+		return Delivery{}, false
+	}
+	serialized, err := lists.Pop(ctx, spillKey(p.options.Scope, p.name))
+	if err != nil {
+		if err == ErrListEmpty {
+			p.spilled.Store(false)
+		} else {
+			log.Printf("[%s] Failed to read spilled message: %v", p.name, err)
+		}
+		return Delivery{}, false
+	}
+
+	var message spilledMessage
+	if err := json.Unmarshal(serialized, &message); err != nil {
+		log.Printf("[%s] Discarding unreadable spilled message: %v", p.name, err)
+		return Delivery{}, false
+	}
+	delivery := newDelivery(message.Channel, message.Payload)
+	delivery.Pattern = message.Pattern
+	return delivery, true
+}
+
+// work handles buffered deliveries, then spilled ones once the buffer is
+// empty, until the queue is closed and drained.
+func (p *workerPool) work(ctx context.Context) {
+	for {
+		select {
+		case delivery, ok := <-p.queue:
+			if !ok {
+				return
+			}
+			p.handle(ctx, delivery)
+			continue
+		default:
+		}
+
+		if p.spilled.Load() {
+			if delivery, ok := p.unspill(ctx); ok {
+				p.handle(ctx, delivery)
+				continue
+			}
+		}
+
+		delivery, ok := <-p.queue
+		if !ok {
+			return
+		}
+		p.handle(ctx, delivery)
+	}
+}
+
+func (p *workerPool) handle(ctx context.Context, delivery Delivery) {
+	// Without redelivery an in-flight duplicate is left to its first
+	// delivery, which is dead-lettered itself if it fails.
+	if err := p.consumer.dispatch(ctx, delivery); err != nil && err != ErrInFlight {
+		p.consumer.sendToDeadLetter(ctx, delivery, err, 1)
+	}
+}
+
+// close stops accepting deliveries; workers exit after draining the buffer.
+func (p *workerPool) close() {
+	close(p.queue)
+}
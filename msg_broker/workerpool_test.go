@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newIdlePool returns a pool without workers, so submitted deliveries stay
+// in its buffer.
+func newIdlePool(broker Broker, overflow OverflowPolicy) *workerPool {
+	return &workerPool{
+		name:     "orders",
+		options:  WorkerOptions{Workers: 1, BufferSize: 2, Overflow: overflow},
+		consumer: NewMessageConsumer(broker),
+		queue:    make(chan Delivery, 2),
+	}
+}
+
+func testDelivery(i int) Delivery {
+	payload := []byte(fmt.Sprintf(`{"id":"m%d","content_type":"application/json","data":%d}`, i, i))
+	return newDelivery("orders", payload)
+}
+
+func buffered(pool *workerPool) []string {
+	var ids []string
+	for len(pool.queue) > 0 {
+		ids = append(ids, (<-pool.queue).Envelope.ID)
+	}
+	return ids
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	tests := []struct {
+		overflow OverflowPolicy
+		want     string
+	}{
+		{OverflowDropNewest, "[m1 m2]"},
+		{OverflowDropOldest, "[m2 m3]"},
+		{OverflowSpill, "[m1 m2]"},
+	}
+	for _, test := range tests {
+		pool := newIdlePool(NewMemoryBroker(), test.overflow)
+		for i := 1; i <= 3; i++ {
+			pool.submit(context.Background(), testDelivery(i))
+		}
+		if got := fmt.Sprint(buffered(pool)); got != test.want {
+			t.Errorf("overflow %d: buffered %s, want %s", test.overflow, got, test.want)
+		}
+	}
+}
+
+func TestWorkerPoolSpillKeepsOverflow(t *testing.T) {
+	broker := NewMemoryBroker()
+	pool := newIdlePool(broker, OverflowSpill)
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		delivery := testDelivery(i)
+		delivery.Pattern = "ord*"
+		pool.submit(ctx, delivery)
+	}
+	if spilled, _ := broker.Len(ctx, spillKey("", "orders")); spilled != 1 || !pool.spilled.Load() {
+		t.Fatalf("spilled %d messages (flag %v), want 1", spilled, pool.spilled.Load())
+	}
+
+	delivery, ok := pool.unspill(ctx)
+	if !ok || delivery.Envelope.ID != "m3" || delivery.Pattern != "ord*" {
+		t.Fatalf("unspill() = %+v, %v; want m3 with its pattern", delivery, ok)
+	}
+	if _, ok := pool.unspill(ctx); ok || pool.spilled.Load() {
+		t.Fatal("spill list should be empty and the flag cleared")
+	}
+}
+
+func TestWorkerPoolBlock(t *testing.T) {
+	pool := newIdlePool(NewMemoryBroker(), OverflowBlock)
+	ctx := context.Background()
+	pool.submit(ctx, testDelivery(1))
+	pool.submit(ctx, testDelivery(2))
+
+	submitted := make(chan struct{})
+	go func() {
+		pool.submit(ctx, testDelivery(3))
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submit did not block on a full buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	<-pool.queue
+	<-submitted
+	if got := fmt.Sprint(buffered(pool)); got != "[m2 m3]" {
+		t.Fatalf("buffered %s, want [m2 m3]", got)
+	}
+
+	// A blocked submit gives up, dropping the message, on shutdown.
+	pool.submit(ctx, testDelivery(4))
+	pool.submit(ctx, testDelivery(5))
+	shutdown, cancel := context.WithCancel(ctx)
+	cancel()
+	pool.submit(shutdown, testDelivery(6))
+	if got := fmt.Sprint(buffered(pool)); got != "[m4 m5]" {
+		t.Fatalf("buffered %s, want [m4 m5]", got)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for name, want := range map[string]OverflowPolicy{
+		"":            OverflowBlock,
+		"block":       OverflowBlock,
+		"drop-oldest": OverflowDropOldest,
+		"drop-newest": OverflowDropNewest,
+		"spill":       OverflowSpill,
+	} {
+		if got, err := ParseOverflowPolicy(name); err != nil || got != want {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop-all"); err == nil {
+		t.Error("ParseOverflowPolicy accepted an unknown policy")
+	}
+}
+
+func TestWorkerPoolSpillIsScopedPerConsumer(t *testing.T) {
+	broker := NewMemoryBroker()
+	ctx := context.Background()
+	billing := newIdlePool(broker, OverflowSpill)
+	billing.options.Scope = "billing"
+	audit := newIdlePool(broker, OverflowSpill)
+	audit.options.Scope = "audit"
+
+	for i := 1; i <= 3; i++ {
+		billing.submit(ctx, testDelivery(i))
+	}
+	audit.spilled.Store(true)
+	if delivery, ok := audit.unspill(ctx); ok {
+		t.Fatalf("audit took billing's spilled message %s", delivery.Envelope.ID)
+	}
+	if delivery, ok := billing.unspill(ctx); !ok || delivery.Envelope.ID != "m3" {
+		t.Fatalf("billing unspill() = %+v, %v; want m3", delivery, ok)
+	}
+}
+
+func TestWorkerOptionsInheritScope(t *testing.T) {
+	consumer := NewMessageConsumer(NewMemoryBroker())
+	consumer.SetWorkerOptions(WorkerOptions{Scope: "billing"})
+	consumer.SetChannelWorkerOptions("audit", WorkerOptions{Workers: 2, Overflow: OverflowSpill})
+	consumer.SetChannelWorkerOptions("reports", WorkerOptions{Overflow: OverflowSpill, Scope: "reports"})
+
+	if scope := consumer.workerOptionsFor("audit").Scope; scope != "billing" {
+		t.Errorf("audit scope = %q, want billing", scope)
+	}
+	if scope := consumer.workerOptionsFor("reports").Scope; scope != "reports" {
+		t.Errorf("reports scope = %q, want reports", scope)
+	}
+}